@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/clarkmcc/remotenetstack/netstack/vni"
+	"os"
+	"strings"
+)
+
+// config is the configuration of a subcommand.
+type config interface {
+	bind(fs *flag.FlagSet)
+	common() *commonConfig
+}
+
+// commonConfig configures the libp2p host and the interface of both subcommands.
+type commonConfig struct {
+	path string // The config file, which is only set with a flag
+
+	LogLevel     string   `json:"log_level"`
+	Identity     string   `json:"identity"`      // Path of the host's private key, created when it doesn't exist
+	Listen       []string `json:"listen"`        // Multiaddrs that the host listens on
+	Relays       []string `json:"relays"`        // Multiaddrs of static relays, including their peer IDs
+	HolePunching bool     `json:"hole_punching"` // Whether to upgrade relayed connections using hole punching
+	NATPortMap   bool     `json:"nat_port_map"`  // Whether to open a port in the NAT's firewall using UPnP
+	AllowedPeers []string `json:"allowed_peers"` // Peer IDs that may connect, every peer may connect when empty unless it's an exit
+	MTU          uint32   `json:"mtu"`
+	Leases       bool     `json:"leases"` // Whether exits lease addresses to entrances
+}
+
+func (c *commonConfig) common() *commonConfig {
+	return c
+}
+
+func (c *commonConfig) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.path, "config", "", "JSON config `file`, flags take precedence over its values")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log `level`: debug, info, warn or error")
+	fs.StringVar(&c.Identity, "identity", c.Identity, "`path` of the host's private key, created when it doesn't exist")
+	fs.Var(newListFlag(&c.Listen), "listen", "`multiaddr` to listen on, can be repeated")
+	fs.Var(newListFlag(&c.Relays), "relay", "`multiaddr` of a static relay with its peer ID, can be repeated")
+	fs.BoolVar(&c.HolePunching, "hole-punching", c.HolePunching, "upgrade relayed connections using hole punching")
+	fs.BoolVar(&c.NATPortMap, "nat-port-map", c.NATPortMap, "open a port in the NAT's firewall using UPnP")
+	fs.Var(newListFlag(&c.AllowedPeers), "allow-peer", "peer `ID` that may connect, can be repeated, exits require one unless -allow-any-peer is set")
+	fs.Var(uint32Flag{&c.MTU}, "mtu", "maximum transmission `unit` of the interface")
+	fs.BoolVar(&c.Leases, "leases", c.Leases, "lease addresses from the exit, required when several entrances share an exit")
+}
+
+// exitConfig configures rns exit.
+type exitConfig struct {
+	commonConfig
+	Routes       []string      `json:"routes"`         // Prefixes that entrances can reach through the exit
+	DNS          bool          `json:"dns"`            // Whether to answer DNS queries from entrances
+	ACL          *vni.ACL      `json:"acl"`            // Decides which flows to the routes are forwarded
+	Reverse      []vni.Mapping `json:"reverse"`        // Host addresses that are forwarded to entrances
+	AllowAnyPeer bool          `json:"allow_any_peer"` // Whether every peer may connect when AllowedPeers is empty
+}
+
+func newExitConfig() config {
+	return &exitConfig{
+		commonConfig: commonConfig{LogLevel: "info", MTU: 1500, Leases: true},
+		DNS:          true,
+	}
+}
+
+func (c *exitConfig) bind(fs *flag.FlagSet) {
+	c.commonConfig.bind(fs)
+	fs.Var(newListFlag(&c.Routes), "route", "`prefix` that entrances can reach through the exit, can be repeated")
+	fs.BoolVar(&c.DNS, "dns", c.DNS, "answer DNS queries from entrances with the host's resolver")
+	fs.Var(newMappingsFlag(&c.Reverse), "reverse", "forward a host address to an entrance, as `listen->remote`, can be repeated")
+	fs.BoolVar(&c.AllowAnyPeer, "allow-any-peer", c.AllowAnyPeer, "let every peer connect and use the exit when no -allow-peer is set")
+}
+
+// validate checks that the exit isn't an open relay by accident. Without allowed peers, every
+// peer that can reach the host could send traffic out of the exit's network.
+func (c *exitConfig) validate() error {
+	if len(c.AllowedPeers) == 0 && !c.AllowAnyPeer {
+		return errors.New("exits need at least one -allow-peer, or -allow-any-peer to let every peer connect")
+	}
+	return nil
+}
+
+// entranceConfig configures rns entrance.
+type entranceConfig struct {
+	commonConfig
+	Exit         string            `json:"exit"`         // Multiaddr of the exit, including its peer ID
+	SOCKS        string            `json:"socks"`        // Host address of the SOCKS5 proxy
+	HTTPProxy    string            `json:"http_proxy"`   // Host address of the HTTP proxy
+	Users        map[string]string `json:"users"`        // Usernames and passwords that the proxies require
+	Destinations []string          `json:"destinations"` // Destinations that the HTTP proxy may connect to
+	RemoteDNS    bool              `json:"remote_dns"`   // Whether the proxies resolve hostnames with the exit's DNS server
+	Forward      []vni.Mapping     `json:"forward"`      // Host addresses that are forwarded through the tunnel
+}
+
+func newEntranceConfig() config {
+	return &entranceConfig{
+		commonConfig: commonConfig{LogLevel: "info", MTU: 1500, Leases: true},
+		RemoteDNS:    true,
+	}
+}
+
+func (c *entranceConfig) bind(fs *flag.FlagSet) {
+	c.commonConfig.bind(fs)
+	fs.StringVar(&c.Exit, "exit", c.Exit, "`multiaddr` of the exit, including its peer ID")
+	fs.StringVar(&c.SOCKS, "socks", c.SOCKS, "host `address` to serve a SOCKS5 proxy on")
+	fs.StringVar(&c.HTTPProxy, "http-proxy", c.HTTPProxy, "host `address` to serve an HTTP proxy on")
+	fs.Var(usersFlag{&c.Users}, "user", "`username:password` that the proxies require, can be repeated")
+	fs.Var(newListFlag(&c.Destinations), "allow-destination", "`destination` that the HTTP proxy may connect to, can be repeated")
+	fs.BoolVar(&c.RemoteDNS, "remote-dns", c.RemoteDNS, "resolve hostnames with the exit's DNS server")
+	fs.Var(newMappingsFlag(&c.Forward), "forward", "forward a host address through the tunnel, as `listen->remote`, can be repeated")
+}
+
+// parseConfig parses the flags of a subcommand. If they name a config file, the file is
+// loaded first and the flags override its values.
+func parseConfig(name string, args []string, newConfig func() config) (config, error) {
+	cfg := newConfig()
+	fs := newFlagSet(name, cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	path := cfg.common().path
+	if path == "" {
+		return cfg, nil
+	}
+	cfg = newConfig()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err = newFlagSet(name, cfg).Parse(args); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func newFlagSet(name string, cfg config) *flag.FlagSet {
+	fs := flag.NewFlagSet("rns "+name, flag.ContinueOnError)
+	cfg.bind(fs)
+	return fs
+}
+
+// listFlag is a flag that can be repeated, and whose values can be separated by commas. The
+// flag replaces the values from the config file rather than adding to them.
+type listFlag struct {
+	p   *[]string
+	set bool
+}
+
+func newListFlag(p *[]string) *listFlag {
+	return &listFlag{p: p}
+}
+
+func (f *listFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	return strings.Join(*f.p, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	if !f.set {
+		*f.p, f.set = nil, true
+	}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f.p = append(*f.p, v)
+		}
+	}
+	return nil
+}
+
+// mappingsFlag is a flag that can be repeated to add port forwarding mappings.
+type mappingsFlag struct {
+	p   *[]vni.Mapping
+	set bool
+}
+
+func newMappingsFlag(p *[]vni.Mapping) *mappingsFlag {
+	return &mappingsFlag{p: p}
+}
+
+func (f *mappingsFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	s := make([]string, 0, len(*f.p))
+	for _, m := range *f.p {
+		s = append(s, m.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *mappingsFlag) Set(s string) error {
+	m, err := vni.ParseMapping(s)
+	if err != nil {
+		return err
+	}
+	if !f.set {
+		*f.p, f.set = nil, true
+	}
+	*f.p = append(*f.p, m)
+	return nil
+}
+
+// usersFlag is a flag that can be repeated to add username:password pairs.
+type usersFlag struct {
+	p *map[string]string
+}
+
+func (f usersFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	users := make([]string, 0, len(*f.p))
+	for user := range *f.p {
+		users = append(users, user+":***")
+	}
+	return strings.Join(users, ",")
+}
+
+func (f usersFlag) Set(s string) error {
+	user, password, ok := strings.Cut(s, ":")
+	if !ok || user == "" {
+		return fmt.Errorf("invalid user %q, expected username:password", s)
+	}
+	if *f.p == nil {
+		*f.p = map[string]string{}
+	}
+	(*f.p)[user] = password
+	return nil
+}
+
+type uint32Flag struct {
+	p *uint32
+}
+
+func (f uint32Flag) String() string {
+	if f.p == nil {
+		return "0"
+	}
+	return fmt.Sprint(*f.p)
+}
+
+func (f uint32Flag) Set(s string) error {
+	_, err := fmt.Sscan(s, f.p)
+	return err
+}
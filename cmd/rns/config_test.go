@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/clarkmcc/remotenetstack/netstack/vni"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfig writes a config file and returns its path.
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	c, err := parseConfig("exit", nil, newExitConfig)
+	require.NoError(t, err)
+	cfg := c.(*exitConfig)
+	require.Equal(t, "info", cfg.LogLevel)
+	require.Equal(t, uint32(1500), cfg.MTU)
+	require.True(t, cfg.Leases)
+	require.True(t, cfg.DNS)
+	require.Empty(t, cfg.Routes)
+
+	c, err = parseConfig("entrance", []string{"-exit", "/ip4/127.0.0.1/tcp/4001", "-mtu", "1280", "-remote-dns=false"}, newEntranceConfig)
+	require.NoError(t, err)
+	entrance := c.(*entranceConfig)
+	require.Equal(t, "/ip4/127.0.0.1/tcp/4001", entrance.Exit)
+	require.Equal(t, uint32(1280), entrance.MTU)
+	require.False(t, entrance.RemoteDNS)
+}
+
+func TestParseConfigFile(t *testing.T) {
+	path := writeConfig(t, `{
+		"log_level": "debug",
+		"mtu": 1280,
+		"dns": false,
+		"routes": ["10.0.0.0/8", "fd00::/8"],
+		"allowed_peers": ["a"],
+		"reverse": ["127.0.0.1:8080->10.1.2.3:80"]
+	}`)
+
+	t.Run("file", func(t *testing.T) {
+		c, err := parseConfig("exit", []string{"-config", path}, newExitConfig)
+		require.NoError(t, err)
+		cfg := c.(*exitConfig)
+		require.Equal(t, "debug", cfg.LogLevel)
+		require.Equal(t, uint32(1280), cfg.MTU)
+		require.False(t, cfg.DNS)
+		require.True(t, cfg.Leases, "values missing from the file keep their defaults")
+		require.Equal(t, []string{"10.0.0.0/8", "fd00::/8"}, cfg.Routes)
+		require.Equal(t, []string{"a"}, cfg.AllowedPeers)
+		require.Equal(t, []vni.Mapping{{Network: "tcp", Listen: "127.0.0.1:8080", Remote: netip.MustParseAddrPort("10.1.2.3:80")}}, cfg.Reverse)
+	})
+
+	t.Run("flags override the file", func(t *testing.T) {
+		// Flags given before -config still take precedence over the file
+		c, err := parseConfig("exit", []string{"-log-level", "warn", "-config", path, "-dns", "-mtu", "1400"}, newExitConfig)
+		require.NoError(t, err)
+		cfg := c.(*exitConfig)
+		require.Equal(t, "warn", cfg.LogLevel)
+		require.Equal(t, uint32(1400), cfg.MTU)
+		require.True(t, cfg.DNS)
+		require.Equal(t, []string{"10.0.0.0/8", "fd00::/8"}, cfg.Routes)
+	})
+
+	t.Run("list flags replace the file", func(t *testing.T) {
+		args := []string{
+			"-config", path,
+			"-route", "192.168.0.0/16",
+			"-route", "172.16.0.0/12,100.64.0.0/10",
+			"-reverse", ":2222->10.1.2.3:22",
+		}
+		c, err := parseConfig("exit", args, newExitConfig)
+		require.NoError(t, err)
+		cfg := c.(*exitConfig)
+		require.Equal(t, []string{"192.168.0.0/16", "172.16.0.0/12", "100.64.0.0/10"}, cfg.Routes)
+		require.Equal(t, []string{"a"}, cfg.AllowedPeers)
+		require.Equal(t, []vni.Mapping{{Network: "tcp", Listen: ":2222", Remote: netip.MustParseAddrPort("10.1.2.3:22")}}, cfg.Reverse)
+	})
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	_, err := parseConfig("exit", []string{"-route", "10.0.0.0/8", "extra"}, newExitConfig)
+	require.EqualError(t, err, `unexpected arguments ["extra"]`)
+
+	_, err = parseConfig("exit", []string{"-config", writeConfig(t, `{"mtu": "large"}`)}, newExitConfig)
+	require.ErrorContains(t, err, "parsing ")
+
+	_, err = parseConfig("exit", []string{"-config", filepath.Join(t.TempDir(), "missing.json")}, newExitConfig)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = parseConfig("entrance", []string{"-user", "nopassword"}, newEntranceConfig)
+	require.ErrorContains(t, err, "invalid user")
+}
+
+func TestExitConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		err  bool
+	}{
+		{name: "no peers", args: nil, err: true},
+		{name: "allowed peer", args: []string{"-allow-peer", "a"}},
+		{name: "any peer", args: []string{"-allow-any-peer"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := parseConfig("exit", tc.args, newExitConfig)
+			require.NoError(t, err)
+			if err = c.(*exitConfig).validate(); tc.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	c, err := parseConfig("exit", []string{"-config", writeConfig(t, `{"allow_any_peer": true}`)}, newExitConfig)
+	require.NoError(t, err)
+	require.NoError(t, c.(*exitConfig).validate())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	netstackhttp "github.com/clarkmcc/remotenetstack/netstack/http"
+	netstacksocks5 "github.com/clarkmcc/remotenetstack/netstack/socks5"
+	"github.com/clarkmcc/remotenetstack/netstack/vni"
+	transportp2p "github.com/clarkmcc/remotenetstack/transport/libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// connectTimeout is how long the entrance waits to connect to the exit and get a lease.
+const connectTimeout = 30 * time.Second
+
+// runEntrance connects to the exit and serves the proxies and port forwards through it until
+// the context is canceled or the interface fails.
+func runEntrance(ctx context.Context, logger *zap.Logger, c config) error {
+	cfg := c.(*entranceConfig)
+	if cfg.Exit == "" {
+		return errors.New("the exit's multiaddr is required")
+	}
+	exit, err := peer.AddrInfoFromString(cfg.Exit)
+	if err != nil {
+		return fmt.Errorf("invalid exit %q: %w", cfg.Exit, err)
+	}
+	var closers cleanup
+	defer closers.run()
+
+	h, transportOpts, err := newHost(&cfg.commonConfig)
+	if err != nil {
+		return err
+	}
+	closers.add(func(context.Context) { _ = h.Close() })
+	t, err := transportp2p.New(h, nil, append(transportOpts, transportp2p.WithLogger(logger))...)
+	if err != nil {
+		return err
+	}
+	closers.add(func(context.Context) { _ = t.Close() })
+
+	connectCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	if err = h.Connect(connectCtx, *exit); err != nil {
+		return fmt.Errorf("connecting to the exit: %w", err)
+	}
+	link, err := t.DialLink(connectCtx, exit.ID)
+	if err != nil {
+		return fmt.Errorf("opening a link to the exit: %w", err)
+	}
+	closers.add(func(context.Context) { _ = link.Close() })
+
+	iface, err := vni.New(vni.Config{
+		Logger:    logger,
+		Mode:      vni.Entrance,
+		LinkLayer: link,
+		MTU:       cfg.MTU,
+		Leases:    cfg.Leases,
+		DNS:       cfg.RemoteDNS,
+	})
+	if err != nil {
+		return err
+	}
+	closers.add(func(ctx context.Context) { _ = iface.Close(ctx) })
+	// Route the prefixes that the exit advertises to it, which matters once the interface
+	// routes to more than one exit
+	stopRoutes := t.InstallRoutes(exit.ID, iface, 1)
+	closers.add(func(context.Context) { stopRoutes() })
+	if cfg.Leases {
+		if err = iface.WaitLease(connectCtx); err != nil {
+			return fmt.Errorf("leasing an address from the exit: %w", err)
+		}
+	}
+	logger.Info("connected to exit", zap.Stringer("exit", exit.ID), zap.Stringers("addresses", iface.Addresses()))
+
+	resolver := net.DefaultResolver
+	if cfg.RemoteDNS {
+		if resolver, err = iface.Resolver(netip.AddrPort{}); err != nil {
+			return err
+		}
+	}
+
+	if cfg.SOCKS != "" {
+		opts := []netstacksocks5.Option{
+			netstacksocks5.WithLogger(logger.Named("socks5")),
+			netstacksocks5.WithResolver(resolver),
+		}
+		for user, password := range cfg.Users {
+			opts = append(opts, netstacksocks5.WithCredentials(user, password))
+		}
+		s, err := netstacksocks5.NewServer(iface, opts...)
+		if err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", cfg.SOCKS)
+		if err != nil {
+			return err
+		}
+		closers.add(func(context.Context) { _ = s.Close() })
+		go func() {
+			if err := s.Serve(ln); !errors.Is(err, netstacksocks5.ErrServerClosed) {
+				logger.Error("serving socks5 proxy", zap.Error(err))
+			}
+		}()
+		logger.Info("serving socks5 proxy", zap.Stringer("addr", ln.Addr()))
+	}
+
+	if cfg.HTTPProxy != "" {
+		opts := []netstackhttp.Option{
+			netstackhttp.WithLogger(logger.Named("http-proxy")),
+			netstackhttp.WithResolver(resolver),
+			netstackhttp.WithAllowedDestinations(cfg.Destinations...),
+			netstackhttp.WithPACRoutes(func() []netip.Prefix {
+				return t.RemoteRoutes()[exit.ID]
+			}),
+		}
+		for user, password := range cfg.Users {
+			opts = append(opts, netstackhttp.WithCredentials(user, password))
+		}
+		p, err := netstackhttp.NewProxy(iface.Stack, 0, opts...)
+		if err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", cfg.HTTPProxy)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: p}
+		closers.add(func(ctx context.Context) { _ = srv.Shutdown(ctx) })
+		go func() {
+			if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("serving http proxy", zap.Error(err))
+			}
+		}()
+		logger.Info("serving http proxy", zap.Stringer("addr", ln.Addr()))
+	}
+
+	if len(cfg.Forward) > 0 {
+		f, err := iface.Forward(cfg.Forward...)
+		if err != nil {
+			return err
+		}
+		closers.add(func(ctx context.Context) { _ = f.Close(ctx) })
+		for _, s := range f.Stats() {
+			logger.Info("forwarding port", zap.Stringer("listen", s.Addr), zap.Stringer("mapping", s.Mapping))
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		logger.Info("shutting down")
+		return nil
+	case <-iface.Done():
+		return iface.Err()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"github.com/clarkmcc/remotenetstack/netstack/vni"
+	transportp2p "github.com/clarkmcc/remotenetstack/transport/libp2p"
+	"go.uber.org/zap"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+)
+
+// runExit accepts links from entrances and forwards their traffic to the exposed routes until
+// the context is canceled or the interface fails.
+func runExit(ctx context.Context, logger *zap.Logger, c config) error {
+	cfg := c.(*exitConfig)
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	var closers cleanup
+	defer closers.run()
+
+	h, transportOpts, err := newHost(&cfg.commonConfig)
+	if err != nil {
+		return err
+	}
+	closers.add(func(context.Context) { _ = h.Close() })
+
+	// Packets from every entrance arrive on the transport's endpoint, which is the linkLayer
+	// of the exit interface
+	ep := channel.New(512, cfg.MTU, "")
+	t, err := transportp2p.New(h, ep, append(transportOpts, transportp2p.WithLogger(logger))...)
+	if err != nil {
+		return err
+	}
+	closers.add(func(context.Context) { _ = t.Close() })
+	link := netstack.NewChannelLink(ep)
+	closers.add(func(context.Context) { _ = link.Close() })
+
+	iface, err := vni.New(vni.Config{
+		Logger:    logger,
+		Mode:      vni.Exit,
+		LinkLayer: link,
+		MTU:       cfg.MTU,
+		Leases:    cfg.Leases,
+		ACL:       cfg.ACL,
+		DNS:       cfg.DNS,
+	})
+	if err != nil {
+		return err
+	}
+	closers.add(func(ctx context.Context) { _ = iface.Close(ctx) })
+	if err = iface.ExposeRoutes(cfg.Routes); err != nil {
+		return err
+	}
+	t.AdvertiseRoutes(iface.ExposedRoutes())
+
+	for _, m := range cfg.Reverse {
+		r, err := iface.ReverseForward(m.Listen, m.Remote)
+		if err != nil {
+			return err
+		}
+		closers.add(func(context.Context) { _ = r.Close() })
+		logger.Info("forwarding to entrance", zap.Stringer("listen", r.Addr()), zap.Stringer("remote", m.Remote))
+	}
+
+	for _, addr := range h.Addrs() {
+		logger.Info("listening", zap.String("addr", addr.String()+"/p2p/"+h.ID().String()))
+	}
+	logger.Info("exit running", zap.Stringers("routes", iface.ExposedRoutes()))
+	select {
+	case <-ctx.Done():
+		logger.Info("shutting down")
+		return nil
+	case <-iface.Done():
+		return iface.Err()
+	}
+}
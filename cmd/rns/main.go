@@ -0,0 +1,147 @@
+// Command rns runs the exit or the entrance of a remote network interface over libp2p.
+//
+//	rns exit -identity exit.key -listen /ip4/0.0.0.0/tcp/4001 -route 10.0.0.0/8
+//	rns entrance -exit /ip4/203.0.113.1/tcp/4001/p2p/12D3KooW... -socks 127.0.0.1:1080
+//
+// Every flag can also be set in a JSON config file passed with -config. Run a subcommand
+// with -h to list its flags.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	transportp2p "github.com/clarkmcc/remotenetstack/transport/libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/zap"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long open connections are given to finish when the daemon stops.
+const shutdownTimeout = 10 * time.Second
+
+const usage = `Usage: rns <command> [flags]
+
+Commands:
+  exit       forward the traffic of entrances to the exposed routes
+  entrance   connect to an exit and serve proxies and port forwards through it
+
+Run "rns <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var newConfig func() config
+	var run func(ctx context.Context, logger *zap.Logger, cfg config) error
+	switch os.Args[1] {
+	case "exit":
+		newConfig, run = newExitConfig, runExit
+	case "entrance":
+		newConfig, run = newEntranceConfig, runEntrance
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "rns: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	cfg, err := parseConfig(os.Args[1], os.Args[2:], newConfig)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rns %s: %v\n", os.Args[1], err)
+		os.Exit(2)
+	}
+	logger, err := newLogger(cfg.common().LogLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rns %s: %v\n", os.Args[1], err)
+		os.Exit(2)
+	}
+	defer logger.Sync()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err = run(ctx, logger, cfg); err != nil {
+		logger.Error("stopped", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+func newLogger(level string) (*zap.Logger, error) {
+	lvl, err := zap.ParseAtomicLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	cfg := zap.NewProductionConfig()
+	cfg.Level = lvl
+	return cfg.Build()
+}
+
+// newHost creates the libp2p host that the transport runs on.
+func newHost(cfg *commonConfig) (host.Host, []transportp2p.Option, error) {
+	opts := []transportp2p.HostOption{
+		transportp2p.WithIdentity(cfg.Identity),
+		transportp2p.WithListenAddrs(cfg.Listen...),
+	}
+	if len(cfg.Relays) > 0 {
+		relays := make([]peer.AddrInfo, 0, len(cfg.Relays))
+		for _, r := range cfg.Relays {
+			info, err := peer.AddrInfoFromString(r)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid relay %q: %w", r, err)
+			}
+			relays = append(relays, *info)
+		}
+		opts = append(opts, transportp2p.WithRelays(relays...))
+	}
+	if cfg.HolePunching {
+		opts = append(opts, transportp2p.WithHolePunching())
+	}
+	if cfg.NATPortMap {
+		opts = append(opts, transportp2p.WithNATPortMap())
+	}
+	var transportOpts []transportp2p.Option
+	if len(cfg.AllowedPeers) > 0 {
+		ids := make([]peer.ID, 0, len(cfg.AllowedPeers))
+		for _, s := range cfg.AllowedPeers {
+			id, err := peer.Decode(s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid peer ID %q: %w", s, err)
+			}
+			ids = append(ids, id)
+		}
+		opts = append(opts, transportp2p.WithHostAuthorizer(transportp2p.AllowPeers(ids...)))
+		transportOpts = append(transportOpts, transportp2p.WithAllowedPeers(ids...))
+	}
+	h, err := transportp2p.NewHost(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, transportOpts, nil
+}
+
+// cleanup closes the components of a subcommand in the reverse order of their creation.
+type cleanup []func(ctx context.Context)
+
+func (c *cleanup) add(fn func(ctx context.Context)) {
+	*c = append(*c, fn)
+}
+
+func (c cleanup) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for i := len(c) - 1; i >= 0; i-- {
+		c[i](ctx)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/clarkmcc/remotenetstack/netstack"
 	netstackhttp "github.com/clarkmcc/remotenetstack/netstack/http"
 	"github.com/clarkmcc/remotenetstack/transport/libp2p"
-	"github.com/clarkmcc/remotenetstack/utils"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"go.uber.org/zap"
 	"io"
@@ -31,7 +30,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	_, err = transportp2p.New(h1, s1.Endpoint, transportp2p.WithLogger(logger))
+	t1, err := transportp2p.New(h1, s1.Endpoint, transportp2p.WithLogger(logger))
 	if err != nil {
 		panic(err)
 	}
@@ -54,13 +53,13 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	s, err := h1.NewStream(context.Background(), h2.ID(), transportp2p.Protocol)
+
+	// Open a link from the first stack to the second stack
+	link, err := t1.Dial(context.Background(), h2.ID())
 	if err != nil {
 		panic(err)
 	}
-	go utils.Join(s, &netstack.Endpoint{
-		Endpoint: s1.Endpoint,
-	})
+	defer link.Close()
 
 	// Start talking to one stack through the other stack
 	client := netstackhttp.GetClient(s1.Stack, 1,
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	netstackhttp "github.com/clarkmcc/remotenetstack/netstack/http"
@@ -34,7 +35,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	defer entrance.Stop()
+	defer entrance.Close(context.Background())
 
 	// Set up the exit interface.
 	exit, err := vni.New(vni.Config{
@@ -51,7 +52,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	defer exit.Stop()
+	defer exit.Close(context.Background())
 
 	// Get a new http.Client that dials using the netstack
 	client := netstackhttp.GetClient(entrance.Stack, 1,
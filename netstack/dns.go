@@ -0,0 +1,242 @@
+package netstack
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// NewResolver returns a resolver that sends DNS queries through the Stack to the server. Queries
+// are bound to the NIC, or routed using the Stack's routing table when nicID is 0. Like every
+// resolver that uses the Go DNS client, it still consults the host's /etc/hosts first.
+func NewResolver(s *stack.Stack, nicID tcpip.NICID, server netip.AddrPort) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			addr := tcpip.FullAddress{
+				NIC:  nicID,
+				Addr: tcpip.Address(server.Addr().Unmap().AsSlice()),
+				Port: server.Port(),
+			}
+			proto := protocolNumber(server.Addr())
+			switch network {
+			case "udp", "udp4", "udp6":
+				return gonet.DialUDP(s, nil, &addr, proto)
+			case "tcp", "tcp4", "tcp6":
+				return gonet.DialContextTCP(ctx, s, addr, proto)
+			default:
+				return nil, fmt.Errorf("unsupported network %q", network)
+			}
+		},
+	}
+}
+
+// protocolNumber returns the network protocol of the address.
+func protocolNumber(addr netip.Addr) tcpip.NetworkProtocolNumber {
+	if addr.Is6() && !addr.Is4In6() {
+		return ipv6.ProtocolNumber
+	}
+	return ipv4.ProtocolNumber
+}
+
+// maxConcurrentQueries is how many of the queries read by DNSForwarder.ServeUDP are answered at
+// the same time.
+const maxConcurrentQueries = 64
+
+// DNSForwarder answers DNS queries from the userspace network Stack using the host's resolver.
+// A and AAAA queries are answered with Resolver, so they see the same names as the host's
+// programs do, and other queries are forwarded to Upstream.
+type DNSForwarder struct {
+	Logger   *zap.Logger
+	Resolver *net.Resolver // Answers A and AAAA queries, defaults to net.DefaultResolver
+	Upstream string        // The host:port that other queries are forwarded to, defaults to the first nameserver in /etc/resolv.conf
+	TTL      uint32        // The TTL of the answers from Resolver, defaults to 60 seconds
+	Timeout  time.Duration // How long to wait for an answer, defaults to 5 seconds
+}
+
+// ServeUDP answers the queries that are read from the connection until reading fails. At most
+// maxConcurrentQueries are answered at a time, further queries aren't read until one of them is
+// answered.
+func (f *DNSForwarder) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	sem := make(chan struct{}, maxConcurrentQueries)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			res, err := f.Answer(context.Background(), query)
+			if err != nil {
+				f.Logger.Debug("answering query", zap.Stringer("from", addr), zap.Error(err))
+				return
+			}
+			if _, err = conn.WriteTo(res, addr); err != nil {
+				f.Logger.Debug("writing answer", zap.Stringer("to", addr), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// ServeTCP answers the queries of the connections that are accepted from the listener until
+// accepting fails.
+func (f *DNSForwarder) ServeTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				var size uint16
+				if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+					return
+				}
+				query := make([]byte, size)
+				if _, err := io.ReadFull(r, query); err != nil {
+					return
+				}
+				res, err := f.Answer(context.Background(), query)
+				if err != nil {
+					f.Logger.Debug("answering query", zap.Stringer("from", conn.RemoteAddr()), zap.Error(err))
+					return
+				}
+				b := make([]byte, 2, 2+len(res))
+				binary.BigEndian.PutUint16(b, uint16(len(res)))
+				if _, err = conn.Write(append(b, res...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Answer returns the response to the DNS query.
+func (f *DNSForwarder) Answer(ctx context.Context, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if q.Class != dnsmessage.ClassINET || (q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA) {
+		return f.forward(ctx, query)
+	}
+
+	resolver := f.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	// Both address families are looked up, so that names that only have addresses of the other
+	// family aren't reported as missing
+	res := dnsmessage.Header{ID: h.ID, Response: true, RecursionDesired: h.RecursionDesired, RecursionAvailable: true}
+	addrs, err := resolver.LookupNetIP(ctx, "ip", strings.TrimSuffix(q.Name.String(), "."))
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		res.RCode = dnsmessage.RCodeNameError
+	case err != nil:
+		res.RCode = dnsmessage.RCodeServerFailure
+	}
+	ttl := f.TTL
+	if ttl == 0 {
+		ttl = 60
+	}
+
+	b := dnsmessage.NewBuilder(nil, res)
+	b.EnableCompression()
+	if err = b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err = b.Question(q); err != nil {
+		return nil, err
+	}
+	if err = b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+		if q.Type == dnsmessage.TypeA && addr.Unmap().Is4() {
+			err = b.AResource(rh, dnsmessage.AResource{A: addr.Unmap().As4()})
+		} else if q.Type == dnsmessage.TypeAAAA && addr.Is6() && !addr.Is4In6() {
+			err = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// forward sends the query to the upstream server and returns its response.
+func (f *DNSForwarder) forward(ctx context.Context, query []byte) ([]byte, error) {
+	upstream := f.Upstream
+	if upstream == "" {
+		upstream = hostNameserver()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// hostNameserver returns the address of the first nameserver in /etc/resolv.conf, or of a
+// nameserver on localhost if there is none.
+func hostNameserver() string {
+	b, err := os.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+			if addr, err := netip.ParseAddr(fields[1]); err == nil {
+				return net.JoinHostPort(addr.WithZone("").String(), "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
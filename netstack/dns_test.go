@@ -0,0 +1,87 @@
+package netstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"testing"
+	"time"
+)
+
+// dnsQuery returns an A query for the name.
+func dnsQuery(t *testing.T, id uint16, name string) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	require.NoError(t, b.StartQuestions())
+	require.NoError(t, b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}))
+	query, err := b.Finish()
+	require.NoError(t, err)
+	return query
+}
+
+func TestDNSForwarderBoundsQueries(t *testing.T) {
+	// The resolver's lookups block until they're released, so the queries pile up
+	var active, peak atomic.Int64
+	release := make(chan struct{})
+	f := &DNSForwarder{
+		Logger:  zap.NewNop(),
+		Timeout: 10 * time.Second,
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				n := active.Inc()
+				defer active.Dec()
+				for p := peak.Load(); n > p && !peak.CAS(p, n); p = peak.Load() {
+				}
+				select {
+				case <-release:
+				case <-ctx.Done():
+				}
+				return nil, errors.New("no upstream")
+			},
+		},
+	}
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	go func() { _ = f.ServeUDP(server) }()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer client.Close()
+
+	const queries = 3 * maxConcurrentQueries
+	for i := 0; i < queries; i++ {
+		_, err = client.WriteTo(dnsQuery(t, uint16(i), fmt.Sprintf("q%d.example.", i)), server.LocalAddr())
+		require.NoError(t, err)
+	}
+
+	// Every query looks up both address families, so each of them dials up to twice
+	require.Eventually(t, func() bool {
+		return active.Load() >= maxConcurrentQueries
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	require.LessOrEqual(t, peak.Load(), int64(2*maxConcurrentQueries))
+
+	// Once the lookups are released, the remaining queries are answered too
+	close(release)
+	seen := map[uint16]bool{}
+	buf := make([]byte, 65535)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(10*time.Second)))
+	for len(seen) < queries {
+		n, _, err := client.ReadFrom(buf)
+		require.NoError(t, err)
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		require.NoError(t, err)
+		require.Equal(t, dnsmessage.RCodeServerFailure, h.RCode)
+		seen[h.ID] = true
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
 )
 
 // MemoryPipe is used to join two endpoints together, allowing them to communicate.
@@ -34,11 +35,20 @@ func WrapChannel(channel *channel.Endpoint) *Endpoint {
 // the io.Reader and io.Writer interfaces.
 type Endpoint struct {
 	*channel.Endpoint
-	Logger *zap.Logger
+	Logger  *zap.Logger
+	Context context.Context // Reads return io.EOF once the context is canceled
 }
 
 func (e *Endpoint) Read(p []byte) (n int, err error) {
-	pkt := e.ReadContext(context.Background())
+	ctx := e.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	pkt := e.ReadContext(ctx)
+	if pkt == nil {
+		// The context was canceled or the channel was closed
+		return 0, io.EOF
+	}
 	b := pkt.ToBuffer()
 	n = copy(p, b.Flatten())
 	pkt.DecRef()
@@ -0,0 +1,252 @@
+package netstack
+
+import (
+	"container/heap"
+	"github.com/clarkmcc/remotenetstack/utils"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// FaultyMemoryPipe is like MemoryPipe but injects the faults described by config into the
+// packets travelling in both directions between the two endpoints. Each direction gets its own
+// seed, derived from config.Seed, so that their faults aren't identical.
+func FaultyMemoryPipe(c1, c2 *channel.Endpoint, config FaultConfig) {
+	l1 := NewFaultyLink(WrapChannel(c1), config)
+	defer l1.Close()
+	l2 := NewFaultyLink(WrapChannel(c2), reverseFaults(config))
+	defer l2.Close()
+	utils.Join(l1, l2)
+}
+
+// reverseFaults returns the config of the reverse direction of a FaultyMemoryPipe, whose seed
+// is derived from the forward direction's so that the pipe's faults are still reproducible.
+func reverseFaults(config FaultConfig) FaultConfig {
+	config.Seed = rand.New(rand.NewSource(config.Seed)).Int63()
+	return config
+}
+
+// DefaultFaultQueueLimit is the number of packets that a FaultyLink queues for delivery when
+// FaultConfig.QueueLimit isn't set.
+const DefaultFaultQueueLimit = 1024
+
+// FaultConfig describes the faults that a FaultyLink injects into the packets written to it.
+// Probabilities are expressed as a value between 0 and 1.
+type FaultConfig struct {
+	Seed       int64         // Seed for the random number generator, the same seed produces the same faults
+	Loss       float64       // Probability that a packet is dropped
+	Delay      time.Duration // Fixed delay added to every packet
+	Jitter     time.Duration // Maximum random delay added on top of Delay
+	Reorder    float64       // Probability that a packet skips the delay and overtakes the packets queued before it
+	Duplicate  float64       // Probability that a packet is delivered twice
+	Corrupt    float64       // Probability that a random bit is flipped in a packet
+	Bandwidth  int           // Maximum throughput in bytes per second, zero means unlimited
+	QueueLimit int           // Maximum number of packets waiting for delivery, defaults to DefaultFaultQueueLimit
+}
+
+// FaultyLink is a link layer that wraps another link layer and injects packet loss, delay,
+// reordering, duplication, corruption and bandwidth limits into the packets written to it.
+// Reads are passed through to the wrapped link layer untouched, so wrap both ends of a link
+// to inject faults in both directions. It's intended for testing how applications behave
+// when tunneled over an unreliable link.
+type FaultyLink struct {
+	rw     io.ReadWriter
+	config FaultConfig
+	limit  int // Maximum length of the queue
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	queue  faultQueue // Packets waiting to be written to the wrapped link layer
+	seq    uint64     // Sequence number of the last queued packet, keeps equal deadlines in order
+	free   time.Time  // When the bandwidth-limited link is free to send the next packet
+	err    error      // The first error returned by the wrapped link layer
+	closed bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// NewFaultyLink wraps the provided link layer and starts delivering the packets written to
+// it according to config. Callers should Close the link when it's no longer needed.
+func NewFaultyLink(rw io.ReadWriter, config FaultConfig) *FaultyLink {
+	l := &FaultyLink{
+		rw:     rw,
+		config: config,
+		limit:  config.QueueLimit,
+		rng:    rand.New(rand.NewSource(config.Seed)),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if l.limit <= 0 {
+		l.limit = DefaultFaultQueueLimit
+	}
+	go l.worker()
+	return l
+}
+
+func (l *FaultyLink) Read(p []byte) (n int, err error) {
+	return l.rw.Read(p)
+}
+
+// Write schedules the packet for delivery to the wrapped link layer. Dropped packets are
+// reported as written, just like a lossy network would.
+func (l *FaultyLink) Write(p []byte) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if l.err != nil {
+		return 0, l.err
+	}
+	if len(p) == 0 || l.chance(l.config.Loss) {
+		return len(p), nil
+	}
+	if len(l.queue) >= l.limit {
+		// Tail drop, the packet doesn't take up any of the link's bandwidth
+		return len(p), nil
+	}
+
+	// The packet is delivered asynchronously, so we need our own copy of it
+	data := make([]byte, len(p))
+	copy(data, p)
+	if l.chance(l.config.Corrupt) {
+		bit := l.rng.Intn(len(data) * 8)
+		data[bit/8] ^= 1 << (bit % 8)
+	}
+
+	now := time.Now()
+	deadline := now
+	if l.config.Bandwidth > 0 {
+		if l.free.After(deadline) {
+			deadline = l.free
+		}
+		deadline = deadline.Add(time.Duration(len(data)) * time.Second / time.Duration(l.config.Bandwidth))
+		l.free = deadline
+	}
+	if !l.chance(l.config.Reorder) {
+		deadline = deadline.Add(l.config.Delay)
+		if l.config.Jitter > 0 {
+			deadline = deadline.Add(time.Duration(l.rng.Int63n(int64(l.config.Jitter))))
+		}
+	}
+	l.push(data, deadline)
+	if l.chance(l.config.Duplicate) {
+		l.push(data, deadline)
+	}
+	return len(p), nil
+}
+
+// Close stops delivering packets, discards any packets that haven't been delivered yet and
+// closes the wrapped link layer if it implements io.Closer.
+func (l *FaultyLink) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.queue = nil
+	close(l.done)
+	l.mu.Unlock()
+
+	if c, ok := l.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// chance returns true with the given probability. It must be called with the mutex held.
+func (l *FaultyLink) chance(probability float64) bool {
+	return probability > 0 && l.rng.Float64() < probability
+}
+
+// push queues a packet for delivery at the deadline and wakes up the worker. Packets are
+// dropped while the queue is full, like a router's queue that can't keep up with a fast
+// sender. It must be called with the mutex held.
+func (l *FaultyLink) push(data []byte, deadline time.Time) {
+	if len(l.queue) >= l.limit {
+		return
+	}
+	l.seq++
+	heap.Push(&l.queue, &faultPacket{data: data, deadline: deadline, seq: l.seq})
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// worker writes queued packets to the wrapped link layer once their deadline has passed.
+func (l *FaultyLink) worker() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		var wait <-chan time.Time
+		if len(l.queue) > 0 {
+			next := l.queue[0]
+			if d := time.Until(next.deadline); d > 0 {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(d)
+				wait = timer.C
+			} else {
+				heap.Pop(&l.queue)
+				l.mu.Unlock()
+				_, err := l.rw.Write(next.data)
+				if err != nil {
+					l.mu.Lock()
+					l.err = err
+					l.mu.Unlock()
+					return
+				}
+				continue
+			}
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-l.done:
+			return
+		case <-l.wake:
+		case <-wait:
+		}
+	}
+}
+
+// faultPacket is a packet waiting in the FaultyLink's queue.
+type faultPacket struct {
+	data     []byte
+	deadline time.Time
+	seq      uint64
+}
+
+// faultQueue is a heap of packets ordered by their deadline.
+type faultQueue []*faultPacket
+
+func (q faultQueue) Len() int { return len(q) }
+
+func (q faultQueue) Less(i, j int) bool {
+	if q[i].deadline.Equal(q[j].deadline) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].deadline.Before(q[j].deadline)
+}
+
+func (q faultQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *faultQueue) Push(x any) { *q = append(*q, x.(*faultPacket)) }
+
+func (q *faultQueue) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return p
+}
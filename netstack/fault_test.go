@@ -0,0 +1,211 @@
+package netstack
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"math/bits"
+	"sync"
+	"testing"
+	"time"
+)
+
+// packetRecorder is a link layer that records the packets written to it.
+type packetRecorder struct {
+	mu      sync.Mutex
+	packets []recordedPacket
+	block   chan struct{} // Blocks writes until closed, when set
+}
+
+type recordedPacket struct {
+	seq uint32
+	at  time.Time
+}
+
+func (r *packetRecorder) Read([]byte) (int, error) {
+	select {}
+}
+
+func (r *packetRecorder) Write(p []byte) (int, error) {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets = append(r.packets, recordedPacket{seq: binary.BigEndian.Uint32(p), at: time.Now()})
+	return len(p), nil
+}
+
+func (r *packetRecorder) recorded() []recordedPacket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]recordedPacket(nil), r.packets...)
+}
+
+// writePackets writes n packets numbered from first to the link, and returns when they were
+// written.
+func writePackets(t *testing.T, l *FaultyLink, first, n int) []time.Time {
+	written := make([]time.Time, n)
+	for i := 0; i < n; i++ {
+		var p [4]byte
+		binary.BigEndian.PutUint32(p[:], uint32(first+i))
+		written[i] = time.Now()
+		_, err := l.Write(p[:])
+		require.NoError(t, err)
+	}
+	return written
+}
+
+// deliver writes n packets through a FaultyLink with the config, and returns the packets
+// that were delivered once the link is idle.
+func deliver(t *testing.T, config FaultConfig, n int) ([]recordedPacket, []time.Time) {
+	r := &packetRecorder{}
+	l := NewFaultyLink(r, config)
+	defer l.Close()
+	written := writePackets(t, l, 0, n)
+	idle := config.Delay + config.Jitter + 50*time.Millisecond
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.queue) == 0
+	}, 5*time.Second, time.Millisecond)
+	time.Sleep(idle)
+	return r.recorded(), written
+}
+
+func sequence(packets []recordedPacket) []uint32 {
+	seqs := make([]uint32, len(packets))
+	for i, p := range packets {
+		seqs[i] = p.seq
+	}
+	return seqs
+}
+
+func TestFaultyLinkPassthrough(t *testing.T) {
+	packets, _ := deliver(t, FaultConfig{}, 100)
+	require.Len(t, packets, 100)
+	for i, p := range packets {
+		require.Equal(t, uint32(i), p.seq)
+	}
+}
+
+func TestFaultyLinkLoss(t *testing.T) {
+	config := FaultConfig{Seed: 1, Loss: 0.3}
+	packets, _ := deliver(t, config, 1000)
+	require.InDelta(t, 700, len(packets), 60)
+
+	// The same seed drops the same packets
+	again, _ := deliver(t, config, 1000)
+	require.Equal(t, sequence(packets), sequence(again))
+
+	// A different seed drops different packets
+	other, _ := deliver(t, FaultConfig{Seed: 2, Loss: 0.3}, 1000)
+	require.NotEqual(t, sequence(packets), sequence(other))
+}
+
+func TestFaultyLinkDuplicate(t *testing.T) {
+	packets, _ := deliver(t, FaultConfig{Seed: 1, Duplicate: 1}, 100)
+	require.Len(t, packets, 200)
+	for i, p := range packets {
+		require.Equal(t, uint32(i/2), p.seq)
+	}
+
+	packets, _ = deliver(t, FaultConfig{Seed: 1, Duplicate: 0.2, QueueLimit: 4096}, 1000)
+	require.InDelta(t, 1200, len(packets), 60)
+}
+
+func TestFaultyLinkDelay(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	packets, written := deliver(t, FaultConfig{Seed: 1, Delay: delay}, 20)
+	require.Len(t, packets, 20)
+	for i, p := range packets {
+		require.Equal(t, uint32(i), p.seq)
+		require.GreaterOrEqual(t, p.at.Sub(written[p.seq]), delay)
+	}
+}
+
+func TestFaultyLinkReorder(t *testing.T) {
+	config := FaultConfig{Seed: 1, Delay: 20 * time.Millisecond, Reorder: 0.2}
+	packets, _ := deliver(t, config, 200)
+	require.Len(t, packets, 200)
+
+	overtaken := 0
+	for i := 1; i < len(packets); i++ {
+		if packets[i].seq < packets[i-1].seq {
+			overtaken++
+		}
+	}
+	require.Greater(t, overtaken, 0, "no packet was reordered")
+
+	// Reordering is decided by the seed, even though delivery happens in real time
+	again, _ := deliver(t, config, 200)
+	require.Equal(t, sequence(packets), sequence(again))
+}
+
+func TestFaultyLinkQueueLimit(t *testing.T) {
+	r := &packetRecorder{block: make(chan struct{})}
+	l := NewFaultyLink(r, FaultConfig{QueueLimit: 10})
+	defer l.Close()
+
+	// The worker holds on to the first packet while the wrapped link is blocked, so only
+	// QueueLimit packets fit in the queue behind it
+	writePackets(t, l, 0, 1)
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.queue) == 0
+	}, time.Second, time.Millisecond)
+	writePackets(t, l, 1, 100)
+	l.mu.Lock()
+	require.Len(t, l.queue, 10)
+	l.mu.Unlock()
+
+	close(r.block)
+	require.Eventually(t, func() bool {
+		return len(r.recorded()) == 11
+	}, time.Second, time.Millisecond)
+	for i, p := range r.recorded() {
+		require.Equal(t, uint32(i), p.seq, "packets past the limit should be dropped from the tail")
+	}
+}
+
+func TestFaultyLinkCorrupt(t *testing.T) {
+	packets, _ := deliver(t, FaultConfig{Seed: 1, Corrupt: 1}, 100)
+	require.Len(t, packets, 100)
+	for i, p := range packets {
+		require.Equal(t, 1, bits.OnesCount32(p.seq^uint32(i)), "packet %d should have exactly one flipped bit", i)
+	}
+
+	packets, _ = deliver(t, FaultConfig{Seed: 1, Corrupt: 0.3}, 1000)
+	require.Len(t, packets, 1000)
+	corrupted := 0
+	for i, p := range packets {
+		if p.seq != uint32(i) {
+			corrupted++
+		}
+	}
+	require.InDelta(t, 300, corrupted, 60)
+}
+
+func TestFaultyLinkBandwidth(t *testing.T) {
+	// Every packet is 4 bytes, so the link delivers one packet every 10ms
+	const bandwidth, interval = 400, 10 * time.Millisecond
+	packets, written := deliver(t, FaultConfig{Bandwidth: bandwidth}, 20)
+	require.Len(t, packets, 20)
+	for i, p := range packets {
+		require.Equal(t, uint32(i), p.seq)
+		require.GreaterOrEqual(t, p.at.Sub(written[0]), time.Duration(i+1)*interval)
+	}
+	require.Less(t, packets[19].at.Sub(written[0]), 20*interval+200*time.Millisecond)
+}
+
+func TestFaultyMemoryPipeDirections(t *testing.T) {
+	config := FaultConfig{Seed: 1, Loss: 0.3}
+	forward, _ := deliver(t, config, 1000)
+	reverse, _ := deliver(t, reverseFaults(config), 1000)
+	require.InDelta(t, 700, len(reverse), 60)
+	require.NotEqual(t, sequence(forward), sequence(reverse), "both directions drop the same packets")
+
+	// The reverse direction is still decided by the seed
+	again, _ := deliver(t, reverseFaults(config), 1000)
+	require.Equal(t, sequence(reverse), sequence(again))
+}
@@ -14,15 +14,54 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"time"
 )
 
+// Flow describes a connection or UDP flow that a forwarder is about to forward.
+type Flow struct {
+	Protocol    string         // "tcp" or "udp"
+	Source      netip.AddrPort // The address of the peer in the userspace network Stack
+	Destination netip.AddrPort // The address that the forwarder dials
+}
+
+func (f Flow) String() string {
+	return fmt.Sprintf("%s %s -> %s", f.Protocol, f.Source, f.Destination)
+}
+
+// newFlow returns the flow of a forwarder request.
+func newFlow(protocol string, id stack.TransportEndpointID) Flow {
+	src, _ := netip.AddrFromSlice([]byte(id.RemoteAddress))
+	dst, _ := netip.AddrFromSlice([]byte(id.LocalAddress))
+	return Flow{
+		Protocol:    protocol,
+		Source:      netip.AddrPortFrom(src, id.RemotePort),
+		Destination: netip.AddrPortFrom(dst, id.LocalPort),
+	}
+}
+
+// DefaultDialTimeout is how long the TCPForwarder waits for the destination to accept a
+// connection when TCPForwarder.DialTimeout isn't set. The peer's handshake is held open while
+// the forwarder dials, so the timeout is kept short.
+const DefaultDialTimeout = 10 * time.Second
+
+// MaxInFlight is how many TCP handshakes forwarding stacks hold open at the same time while
+// the TCPForwarder dials their destinations. Handshakes beyond it are dropped, and the peers
+// retransmit them.
+const MaxInFlight = 1024
+
 // TCPForwarder knows how to forward TCP traffic from the userspace network Stack to
 // the host's network Stack. TCP dialing requests from the userspace network Stack are
 // done by the host's network Stack which allows userspace traffic to exit the userspace
-// Stack.
+// Stack. Connections that the host refuses are reset, and an ICMP destination unreachable
+// message is written to the Stack when the host can't reach the destination at all.
 type TCPForwarder struct {
 	Logger *zap.Logger
+	Stack  *stack.Stack    // The Stack that ICMP errors are written to, none are written when nil
+	Allow  func(Flow) bool // Decides whether a connection is forwarded, all connections are forwarded when nil
+
+	DialTimeout time.Duration // How long dialing the destination may take, defaults to DefaultDialTimeout
 }
 
 func (f *TCPForwarder) Handle(r *tcp.ForwarderRequest) {
@@ -32,8 +71,39 @@ func (f *TCPForwarder) Handle(r *tcp.ForwarderRequest) {
 		zap.String("local_address", net.IP(req.LocalAddress).String()),
 		zap.Uint16("remote_port", req.RemotePort),
 		zap.String("remote_address", net.IP(req.RemoteAddress).String()))
+	if f.Allow != nil && !f.Allow(newFlow("tcp", req)) {
+		logger.Debug("rejecting tcp")
+		r.Complete(true)
+		return
+	}
 	logger.Debug("forwarding tcp")
 
+	// Establish outbound TCP connection to the target host:port before completing the
+	// handshake, so that failures can be reported to the peer
+	dstAddr := net.JoinHostPort(req.LocalAddress.String(), strconv.Itoa(int(req.LocalPort)))
+	timeout := f.DialTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	var dialer net.Dialer
+	target, err := dialer.DialContext(ctx, "tcp", dstAddr)
+	cancel()
+	if err != nil {
+		logger.Debug("dialing target", zap.Error(err))
+		reason, ok := unreachableReason(err)
+		if !ok || reason == unreachablePort || f.Stack == nil {
+			r.Complete(true)
+			return
+		}
+		r.Complete(false)
+		if err = writeFlowUnreachable(f.Stack, tcp.ProtocolNumber, req, reason); err != nil {
+			logger.Warn("writing destination unreachable", zap.Error(err))
+		}
+		return
+	}
+	defer target.Close()
+
 	var wq waiter.Queue
 	ep, tcpErr := r.CreateEndpoint(&wq)
 	if tcpErr != nil {
@@ -45,15 +115,6 @@ func (f *TCPForwarder) Handle(r *tcp.ForwarderRequest) {
 
 	source := gonet.NewTCPConn(&wq, ep)
 	defer source.Close()
-
-	dstAddr := fmt.Sprintf("%s:%d", req.LocalAddress.String(), req.LocalPort)
-	// Establish outbound TCP connection to the target host:port
-	var dialer net.Dialer
-	target, err := dialer.Dial("tcp", dstAddr)
-	if err != nil {
-		return
-	}
-	defer target.Close()
 	utils.Join(source, target)
 }
 
@@ -98,39 +159,43 @@ type UDPForwarder struct {
 	Stack   *stack.Stack
 	Timeout time.Duration
 	MTU     int
+	Allow   func(Flow) bool // Decides whether a flow is forwarded, all flows are forwarded when nil
 }
 
 func (u *UDPForwarder) Handle(r *udp.ForwarderRequest) {
 	req := r.ID()
 	logger := u.Logger.With(zap.Reflect("req", req))
+	if u.Allow != nil && !u.Allow(newFlow("udp", req)) {
+		logger.Debug("dropping udp")
+		return
+	}
+
+	// The endpoint has to be created before the forwarder returns, otherwise the packet is lost
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		logger.Error("creating endpoint", zap.String("error", tcpErr.String()))
+		return
+	}
+	src := gonet.NewUDPConn(u.Stack, &wq, ep)
 
 	go func() {
 		logger.Info("forwarding udp")
-		var wq waiter.Queue
-		ep, tcpErr := r.CreateEndpoint(&wq)
-		if tcpErr != nil {
-			logger.Error("creating endpoint", zap.String("error", tcpErr.String()))
-			return
-		}
-		src := gonet.NewUDPConn(u.Stack, &wq, ep)
 		defer src.Close()
 
-		// Check if destination is the local Nebula IP and if so, forward to localhost instead
+		// Connect a socket to the target, so that the host reports ICMP errors from it
 		dstAddr := &net.UDPAddr{IP: net.IP(req.LocalAddress), Port: int(req.LocalPort)}
-		localAddr := &net.UDPAddr{IP: net.IP{0, 0, 0, 0}, Port: 0}
-		srcAddr := &net.UDPAddr{IP: net.IP(req.RemoteAddress), Port: int(req.RemotePort)}
-
-		// Set up listener to receive UDP packets coming back from target
-		dest, err := net.ListenUDP("udp", localAddr)
+		dest, err := net.DialUDP("udp", nil, dstAddr)
 		if err != nil {
-			logger.Error("starting udp listener", zap.Error(err))
+			logger.Error("dialing udp target", zap.Error(err))
+			u.writeUnreachable(logger, req, err)
 			return
 		}
 		defer dest.Close()
 
 		// Start a goroutine to copy data in each direction for the proxy and then
 		// wait for completion
-		copy := func(ctx context.Context, dst net.PacketConn, dstAddr net.Addr, src net.PacketConn, errC chan<- error) {
+		copy := func(ctx context.Context, dst io.Writer, src io.Reader, errC chan<- error) {
 			buf := make([]byte, u.MTU)
 			for {
 				select {
@@ -139,9 +204,9 @@ func (u *UDPForwarder) Handle(r *udp.ForwarderRequest) {
 				default:
 					var n int
 					var err error
-					n, _, err = src.ReadFrom(buf)
+					n, err = src.Read(buf)
 					if err == nil {
-						_, err = dst.WriteTo(buf[:n], dstAddr)
+						_, err = dst.Write(buf[:n])
 					}
 
 					// Return error code or nil to the error channel. Nil value
@@ -156,8 +221,8 @@ func (u *UDPForwarder) Handle(r *udp.ForwarderRequest) {
 
 		ctx, cancel := context.WithCancel(context.Background())
 		errors := make(chan error, 2)
-		go copy(ctx, dest, dstAddr, src, errors)
-		go copy(ctx, src, srcAddr, dest, errors)
+		go copy(ctx, dest, src, errors)
+		go copy(ctx, src, dest, errors)
 
 		// Tear down the forwarding if there is no activity after a certain
 		// period of time
@@ -166,6 +231,7 @@ func (u *UDPForwarder) Handle(r *udp.ForwarderRequest) {
 			case err := <-errors:
 				if err != nil {
 					logger.Error("forwarding udp", zap.Error(err))
+					u.writeUnreachable(logger, req, err)
 					keepGoing = false
 				}
 				// If err is nil then this means some activity has occurred, so
@@ -180,6 +246,18 @@ func (u *UDPForwarder) Handle(r *udp.ForwarderRequest) {
 	}()
 }
 
+// writeUnreachable writes an ICMP destination unreachable message about the flow to the Stack if
+// the error means that the target is unreachable.
+func (u *UDPForwarder) writeUnreachable(logger *zap.Logger, id stack.TransportEndpointID, err error) {
+	reason, ok := unreachableReason(err)
+	if !ok {
+		return
+	}
+	if err = writeFlowUnreachable(u.Stack, udp.ProtocolNumber, id, reason); err != nil {
+		logger.Warn("writing destination unreachable", zap.Error(err))
+	}
+}
+
 var _ net.Listener = &singleConnListener{}
 
 // singleConnListener is a net.Listener that only provides a single connection.
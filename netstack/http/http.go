@@ -3,10 +3,9 @@ package netstackhttp
 import (
 	"context"
 	"crypto/tls"
+	"github.com/clarkmcc/remotenetstack/netstack"
 	"go.uber.org/zap"
 	"gvisor.dev/gvisor/pkg/tcpip"
-	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
-	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"net"
 	"net/http"
@@ -29,31 +28,72 @@ func WithLogger(logger *zap.Logger) Option {
 	}
 }
 
+// WithResolver sets the resolver that looks up the hostnames of URLs. Use a resolver from
+// netstack.NewResolver to resolve hostnames through the netstack.
+func WithResolver(resolver *net.Resolver) Option {
+	return func(config *Config) {
+		config.Resolver = resolver
+	}
+}
+
+// WithCredentials requires the clients of a Proxy to authenticate with a username and password
+// using basic auth. It can be used more than once to accept several users.
+func WithCredentials(username, password string) Option {
+	return func(config *Config) {
+		if config.Credentials == nil {
+			config.Credentials = map[string]string{}
+		}
+		config.Credentials[username] = password
+	}
+}
+
+// WithAllowedDestinations only lets a Proxy connect to the destinations, which are hostnames
+// such as "example.com", wildcards such as "*.example.com", addresses or prefixes such as
+// "10.0.0.0/8", each optionally followed by a port, as in "example.com:443" or "[fd00::/8]:80".
+func WithAllowedDestinations(destinations ...string) Option {
+	return func(config *Config) {
+		config.Destinations = append(config.Destinations, destinations...)
+	}
+}
+
+// WithPACRoutes sets the function that returns the routes that the PAC file of a Proxy sends
+// through the proxy, which are usually the routes exposed by the exit. On an entrance, those are
+// the routes that the exit advertised to the transport rather than the entrance's own exposed
+// routes, which are always empty.
+func WithPACRoutes(routes func() []netip.Prefix) Option {
+	return func(config *Config) {
+		config.PACRoutes = routes
+	}
+}
+
 type Config struct {
-	TLSConfig *tls.Config
-	Logger    *zap.Logger
+	TLSConfig    *tls.Config
+	Logger       *zap.Logger
+	Resolver     *net.Resolver         // Looks up the hostnames of URLs, defaults to net.DefaultResolver for clients and is required by a Proxy
+	Credentials  map[string]string     // The users of a Proxy and their passwords, or nil to accept every client
+	Destinations []string              // The destinations that a Proxy may connect to, or nil to allow every destination
+	PACRoutes    func() []netip.Prefix // The routes that a Proxy's PAC file sends through it, or nil to send everything
 }
 
-// GetClient returns an HTTP client that uses the provided netstack as its transport.
+// GetClient returns an HTTP client that uses the provided netstack as its transport. Connections
+// are bound to the NIC, or routed using the netstack's routing table when nicId is 0. Hostnames
+// are looked up with the Config's Resolver, and each of their addresses is tried in turn.
 func GetClient(s *stack.Stack, nicId tcpip.NICID, opts ...Option) *http.Client {
 	cfg := Config{
-		Logger: zap.NewNop(),
+		Logger:   zap.NewNop(),
+		Resolver: net.DefaultResolver,
 	}
 	for _, opt := range opts {
 		opt(&cfg)
 	}
 	logger := cfg.Logger
+	n := &netstack.Net{Stack: s, NIC: nicId, Resolver: cfg.Resolver}
 	return &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: cfg.TLSConfig,
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				address := netip.MustParseAddrPort(addr)
 				logger.Debug("dialing", zap.String("addr", addr), zap.Int("nic", int(nicId)))
-				return gonet.DialTCP(s, tcpip.FullAddress{
-					NIC:  nicId,
-					Addr: tcpip.Address(address.Addr().AsSlice()),
-					Port: address.Port(),
-				}, ipv4.ProtocolNumber)
+				return n.DialContext(ctx, network, addr)
 			},
 		},
 	}
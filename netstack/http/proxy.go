@@ -0,0 +1,317 @@
+package netstackhttp
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"github.com/clarkmcc/remotenetstack/utils"
+	"go.uber.org/zap"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PACPath is the path that a Proxy serves its PAC file on.
+	PACPath = "/proxy.pac"
+
+	dialTimeout = 30 * time.Second
+)
+
+// errForbidden is returned when dialing a destination that the allow list doesn't contain.
+var errForbidden = errors.New("destination is not allowed")
+
+// Proxy is an HTTP proxy that sends its upstream traffic through a netstack. It tunnels CONNECT
+// requests, such as those of HTTPS clients, and forwards requests with absolute URIs. Serve it
+// on a host address with an http.Server, like http.ListenAndServe(":8080", proxy).
+type Proxy struct {
+	logger       *zap.Logger
+	net          *netstack.Net
+	credentials  map[string]string
+	destinations []destination
+	pacRoutes    func() []netip.Prefix
+	proxy        *httputil.ReverseProxy
+}
+
+// NewProxy returns an HTTP proxy that dials through the netstack. Connections are bound to the
+// NIC, or routed using the netstack's routing table when nicId is 0. Only the Config's Logger,
+// TLSConfig, Resolver, Credentials, Destinations and PACRoutes are used. The resolver has to be
+// chosen with WithResolver, since names that clients send through the tunnel usually have to be
+// resolved on the other side of it, such as with the resolver of a vni.Interface. Pass
+// net.DefaultResolver to resolve them on the host instead.
+func NewProxy(s *stack.Stack, nicId tcpip.NICID, opts ...Option) (*Proxy, error) {
+	cfg := Config{
+		Logger: zap.NewNop(),
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.Resolver == nil {
+		return nil, errors.New("proxy needs a resolver, set one with WithResolver")
+	}
+	p := &Proxy{
+		logger:      cfg.Logger,
+		net:         &netstack.Net{Stack: s, NIC: nicId, Resolver: cfg.Resolver},
+		credentials: cfg.Credentials,
+		pacRoutes:   cfg.PACRoutes,
+	}
+	for _, d := range cfg.Destinations {
+		dest, err := parseDestination(d)
+		if err != nil {
+			return nil, err
+		}
+		p.destinations = append(p.destinations, dest)
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// The request already has its destination, and the client's address stays private
+			r.Header["X-Forwarded-For"] = nil
+		},
+		Transport: &http.Transport{
+			DialContext:     p.dial,
+			TLSClientConfig: cfg.TLSConfig,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.logger.Debug("forwarding request", zap.Stringer("url", r.URL), zap.Error(err))
+			writeError(w, err)
+		},
+	}
+	return p, nil
+}
+
+// ServeHTTP proxies the request, or serves the PAC file for requests to PACPath that aren't
+// proxy requests. Clients have to authenticate with basic auth if the proxy has credentials,
+// but the PAC file is served to everyone.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+		if r.URL.Path == PACPath {
+			p.servePAC(w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if !p.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	p.proxy.ServeHTTP(w, r)
+}
+
+// authorized returns whether the request has the credentials of one of the proxy's users.
+func (p *Proxy) authorized(r *http.Request) bool {
+	if p.credentials == nil {
+		return true
+	}
+	const prefix = "Basic "
+	auth := r.Header.Get("Proxy-Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(b), ":")
+	expected, found := p.credentials[username]
+	return ok && found && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// connect dials the destination of a CONNECT request and joins it with the client's connection.
+func (p *Proxy) connect(w http.ResponseWriter, r *http.Request) {
+	logger := p.logger.With(zap.String("host", r.Host), zap.String("client", r.RemoteAddr))
+	ctx, cancel := context.WithTimeout(r.Context(), dialTimeout)
+	target, err := p.dial(ctx, "tcp", r.Host)
+	cancel()
+	if err != nil {
+		logger.Debug("dialing target", zap.Error(err))
+		writeError(w, err)
+		return
+	}
+	defer target.Close()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		logger.Debug("hijacking connection", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	// The client may have sent data after the request, which the server has already read
+	if n := buf.Reader.Buffered(); n > 0 {
+		b, _ := buf.Peek(n)
+		if _, err = target.Write(b); err != nil {
+			return
+		}
+	}
+	logger.Debug("tunneling connection")
+	utils.Join(conn, target)
+}
+
+// dial connects to the address through the netstack if the allow list contains it. Hostnames
+// are allowed by name, or by the addresses that they resolve to, in which case only the allowed
+// addresses are dialed.
+func (p *Proxy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(p.destinations) == 0 {
+		return p.net.DialContext(ctx, network, address)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !p.allowedAddr(addr.Unmap(), uint16(port)) {
+			return nil, errForbidden
+		}
+		return p.net.DialContext(ctx, network, address)
+	}
+	if p.allowedName(host, uint16(port)) {
+		return p.net.DialContext(ctx, network, address)
+	}
+
+	addrs, err := p.net.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	err = errForbidden
+	for _, a := range addrs {
+		addr, perr := netip.ParseAddr(a)
+		if perr != nil || !p.allowedAddr(addr.Unmap(), uint16(port)) {
+			continue
+		}
+		var conn net.Conn
+		conn, err = p.net.DialContext(ctx, network, net.JoinHostPort(a, portStr))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *Proxy) allowedName(host string, port uint16) bool {
+	for _, d := range p.destinations {
+		if d.matchesName(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) allowedAddr(addr netip.Addr, port uint16) bool {
+	for _, d := range p.destinations {
+		if d.matchesAddr(addr, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// servePAC serves a proxy auto-config file that sends requests to the PAC routes through the
+// proxy, at the address that the client reached it at, and every other request directly.
+func (p *Proxy) servePAC(w http.ResponseWriter, r *http.Request) {
+	proxy := strconv.Quote("PROXY " + r.Host)
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	if p.pacRoutes == nil {
+		fmt.Fprintf(&b, "\treturn %s;\n}\n", proxy)
+	} else {
+		b.WriteString("\tvar ip = dnsResolve(host);\n")
+		b.WriteString("\tif (!ip) {\n\t\treturn \"DIRECT\";\n\t}\n")
+		for _, route := range p.pacRoutes() {
+			route = route.Masked()
+			if route.Addr().Is4() {
+				mask := net.IP(net.CIDRMask(route.Bits(), 32)).String()
+				fmt.Fprintf(&b, "\tif (isInNet(ip, %q, %q)) {\n", route.Addr(), mask)
+			} else {
+				// isInNet only supports IPv4, the browsers that resolve IPv6 addresses have isInNetEx
+				fmt.Fprintf(&b, "\tif (typeof isInNetEx == \"function\" && isInNetEx(ip, %q)) {\n", route)
+			}
+			fmt.Fprintf(&b, "\t\treturn %s;\n\t}\n", proxy)
+		}
+		b.WriteString("\treturn \"DIRECT\";\n}\n")
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// writeError responds with the status that describes the error of a dial or a request.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	if errors.Is(err, errForbidden) {
+		status = http.StatusForbidden
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// destination is an entry of a Proxy's allow list.
+type destination struct {
+	name   string       // A hostname, or a wildcard that starts with "*."
+	prefix netip.Prefix // Set instead of name for addresses and prefixes
+	port   uint16       // The allowed port, or 0 to allow every port
+}
+
+// parseDestination parses a hostname, wildcard, address or prefix, optionally followed by a
+// port.
+func parseDestination(s string) (destination, error) {
+	host, port := s, ""
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	}
+	var d destination
+	if port != "" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || n == 0 {
+			return destination{}, fmt.Errorf("invalid port in destination %q", s)
+		}
+		d.port = uint16(n)
+	}
+	if prefix, err := netip.ParsePrefix(host); err == nil {
+		d.prefix = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(host); err == nil {
+		d.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+	} else if host != "" && !strings.ContainsAny(host, "/[]: ") {
+		d.name = strings.ToLower(strings.TrimSuffix(host, "."))
+	} else {
+		return destination{}, fmt.Errorf("invalid destination %q", s)
+	}
+	return d, nil
+}
+
+func (d destination) matchesName(host string, port uint16) bool {
+	if d.name == "" || (d.port != 0 && d.port != port) {
+		return false
+	}
+	if strings.HasPrefix(d.name, "*.") {
+		return strings.HasSuffix(host, d.name[1:])
+	}
+	return host == d.name
+}
+
+func (d destination) matchesAddr(addr netip.Addr, port uint16) bool {
+	return d.prefix.IsValid() && (d.port == 0 || d.port == port) && d.prefix.Contains(addr)
+}
@@ -0,0 +1,235 @@
+package netstackhttp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDestination(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		dest destination
+		err  string
+	}{
+		{s: "example.com", dest: destination{name: "example.com"}},
+		{s: "Example.COM.:443", dest: destination{name: "example.com", port: 443}},
+		{s: "*.example.com", dest: destination{name: "*.example.com"}},
+		{s: "192.0.2.1", dest: destination{prefix: netip.MustParsePrefix("192.0.2.1/32")}},
+		{s: "192.0.2.1:80", dest: destination{prefix: netip.MustParsePrefix("192.0.2.1/32"), port: 80}},
+		{s: "10.1.2.3/8", dest: destination{prefix: netip.MustParsePrefix("10.0.0.0/8")}},
+		{s: "[fd00::/8]:80", dest: destination{prefix: netip.MustParsePrefix("fd00::/8"), port: 80}},
+		{s: "[::ffff:192.0.2.1]:80", dest: destination{prefix: netip.MustParsePrefix("192.0.2.1/32"), port: 80}},
+		{s: "2001:db8::1", dest: destination{prefix: netip.MustParsePrefix("2001:db8::1/128")}},
+		{s: "example.com:0", err: `invalid port in destination "example.com:0"`},
+		{s: "example.com:http", err: `invalid port in destination "example.com:http"`},
+		{s: "example.com:65536", err: `invalid port in destination "example.com:65536"`},
+		{s: "", err: `invalid destination ""`},
+		{s: "foo/bar", err: `invalid destination "foo/bar"`},
+		{s: "exa mple.com", err: `invalid destination "exa mple.com"`},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			dest, err := parseDestination(tc.s)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.dest, dest)
+		})
+	}
+}
+
+func TestDestinationMatches(t *testing.T) {
+	wildcard, err := parseDestination("*.example.com:443")
+	require.NoError(t, err)
+	require.True(t, wildcard.matchesName("www.example.com", 443))
+	require.False(t, wildcard.matchesName("www.example.com", 80))
+	require.False(t, wildcard.matchesName("example.com", 443))
+	require.False(t, wildcard.matchesName("badexample.com", 443))
+
+	prefix, err := parseDestination("10.0.0.0/8")
+	require.NoError(t, err)
+	require.True(t, prefix.matchesAddr(netip.MustParseAddr("10.1.2.3"), 22))
+	require.False(t, prefix.matchesAddr(netip.MustParseAddr("192.0.2.1"), 22))
+	require.False(t, prefix.matchesName("10.1.2.3", 22))
+}
+
+func TestNewProxyNeedsResolver(t *testing.T) {
+	s := stack.New(stack.Options{})
+	defer s.Close()
+	_, err := NewProxy(s, 0)
+	require.EqualError(t, err, "proxy needs a resolver, set one with WithResolver")
+	_, err = NewProxy(s, 0, WithResolver(net.DefaultResolver))
+	require.NoError(t, err)
+}
+
+// newTestProxy serves a proxy that dials through a TestStack at 10.0.0.1, which is connected to
+// another TestStack at 10.0.0.2 that's returned along with the proxy's URL.
+func newTestProxy(t *testing.T, opts ...Option) (*url.URL, *netstack.TestStack) {
+	s1, err := netstack.NewTestStack(zap.NewNop(), "10.0.0.1", []string{"10.0.0.0/24"}, false)
+	require.NoError(t, err)
+	s2, err := netstack.NewTestStack(zap.NewNop(), "10.0.0.2", []string{"10.0.0.0/24"}, false)
+	require.NoError(t, err)
+	go netstack.MemoryPipe(s1.Endpoint, s2.Endpoint)
+	t.Cleanup(func() {
+		s1.Endpoint.Close()
+		s2.Endpoint.Close()
+		s1.Stack.Close()
+		s2.Stack.Close()
+	})
+
+	p, err := NewProxy(s1.Stack, 0, append([]Option{WithResolver(net.DefaultResolver)}, opts...)...)
+	require.NoError(t, err)
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	return u, s2
+}
+
+// serve serves the handler on the port of the TestStack.
+func serve(t *testing.T, s *netstack.TestStack, port int, handler http.Handler) {
+	ln, err := s.Net().Listen("tcp", fmt.Sprintf(":%d", port))
+	require.NoError(t, err)
+	srv := &http.Server{Handler: handler}
+	t.Cleanup(func() { _ = srv.Close() })
+	go func() { _ = srv.Serve(ln) }()
+}
+
+func TestProxyConnect(t *testing.T) {
+	proxyURL, s2 := newTestProxy(t, WithCredentials("user", "secret"))
+	ln, err := s2.Net().Listen("tcp", ":7")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	connect := func(auth string) (*bufio.Reader, net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+		// The data after the request is sent before the proxy has answered
+		req := "CONNECT 10.0.0.2:7 HTTP/1.1\r\nHost: 10.0.0.2:7\r\n"
+		if auth != "" {
+			req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n"
+		}
+		_, err = conn.Write([]byte(req + "\r\nping"))
+		require.NoError(t, err)
+		r := bufio.NewReader(conn)
+		res, err := http.ReadResponse(r, nil)
+		require.NoError(t, err)
+		return r, conn, res
+	}
+
+	// The connection is tunneled through the netstack, including the data sent early
+	r, conn, res := connect("user:secret")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+	_, err = conn.Write([]byte("pong"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buf))
+
+	// Clients without the credentials are asked for them
+	_, _, res = connect("")
+	require.Equal(t, http.StatusProxyAuthRequired, res.StatusCode)
+	require.Equal(t, `Basic realm="proxy"`, res.Header.Get("Proxy-Authenticate"))
+	_, _, res = connect("user:wrong")
+	require.Equal(t, http.StatusProxyAuthRequired, res.StatusCode)
+}
+
+func TestProxyForward(t *testing.T) {
+	proxyURL, s2 := newTestProxy(t, WithAllowedDestinations("10.0.0.2:80"))
+	serve(t, s2, 80, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s %s %q", r.Host, r.URL.Path, r.Header.Get("X-Forwarded-For"))
+	}))
+	serve(t, s2, 81, http.NotFoundHandler())
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+
+	// Requests are forwarded to the destination without the client's address
+	res, err := client.Get("http://10.0.0.2/path")
+	require.NoError(t, err)
+	b, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, `10.0.0.2 /path ""`, string(b))
+
+	// Destinations outside the allow list are forbidden, and unreachable ones are bad gateways
+	res, err = client.Get("http://10.0.0.2:81/")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	proxyURL, _ = newTestProxy(t)
+	client.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	res, err = client.Get("http://10.0.0.2:82/")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+}
+
+func TestProxyPAC(t *testing.T) {
+	get := func(u *url.URL) string {
+		res, err := http.Get(u.String() + PACPath)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "application/x-ns-proxy-autoconfig", res.Header.Get("Content-Type"))
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	// Without routes every request goes through the proxy, at the address the PAC file was
+	// fetched from, even when the proxy has credentials
+	u, _ := newTestProxy(t, WithCredentials("user", "secret"))
+	require.Equal(t, fmt.Sprintf("function FindProxyForURL(url, host) {\n\treturn \"PROXY %s\";\n}\n", u.Host), get(u))
+
+	// With routes, only their destinations do
+	u, _ = newTestProxy(t, WithPACRoutes(func() []netip.Prefix {
+		return []netip.Prefix{netip.MustParsePrefix("10.1.2.3/16"), netip.MustParsePrefix("fd00::/8")}
+	}))
+	pac := get(u)
+	require.Contains(t, pac, `if (isInNet(ip, "10.1.0.0", "255.255.0.0")) {`)
+	require.Contains(t, pac, `isInNetEx(ip, "fd00::/8")`)
+	require.Contains(t, pac, fmt.Sprintf(`return "PROXY %s";`, u.Host))
+	require.True(t, strings.HasSuffix(pac, "\treturn \"DIRECT\";\n}\n"))
+
+	// Other paths aren't served
+	res, err := http.Get(u.String() + "/other")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
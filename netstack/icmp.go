@@ -0,0 +1,382 @@
+package netstack
+
+import (
+	"context"
+	"errors"
+	"github.com/clarkmcc/remotenetstack/utils"
+	"go.uber.org/zap"
+	"golang.org/x/net/icmp"
+	xipv4 "golang.org/x/net/ipv4"
+	xipv6 "golang.org/x/net/ipv6"
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"time"
+)
+
+// defaultEchoTimeout is how long the ICMPForwarder waits for echo replies when no Timeout is set.
+const defaultEchoTimeout = 10 * time.Second
+
+// ICMPForwarder forwards ICMP echo requests from the userspace network Stack through the host's
+// network Stack using unprivileged ping sockets, and writes the replies back to the Stack, which
+// routes them to the requester. Linux only allows ping sockets for the groups in the
+// net.ipv4.ping_group_range sysctl.
+type ICMPForwarder struct {
+	Logger  *zap.Logger
+	Stack   *stack.Stack
+	Timeout time.Duration   // How long to wait for an echo reply, defaults to 10 seconds
+	Allow   func(Flow) bool // Decides whether an echo request is forwarded, all requests are forwarded when nil
+}
+
+// echoRequest is an ICMP echo request read from a link layer.
+type echoRequest struct {
+	netProto tcpip.NetworkProtocolNumber
+	src      tcpip.Address
+	dst      tcpip.Address
+	ident    uint16
+	seq      uint16
+	data     []byte
+}
+
+// HandlePacket forwards the IP packet, which was read from the link layer of the NIC, if it's an
+// echo request to an address that isn't local to the Stack. It returns whether the packet was
+// handled, packets that weren't must be injected into the Stack as usual.
+func (f *ICMPForwarder) HandlePacket(nicID tcpip.NICID, pkt []byte) bool {
+	req, ok := parseEchoRequest(pkt)
+	if !ok || assigned(f.Stack, nicID, req.dst) {
+		return false
+	}
+	src, _ := netip.AddrFromSlice([]byte(req.src))
+	dst, _ := netip.AddrFromSlice([]byte(req.dst))
+	flow := Flow{Protocol: "icmp", Source: netip.AddrPortFrom(src, 0), Destination: netip.AddrPortFrom(dst, 0)}
+	if f.Allow != nil && !f.Allow(flow) {
+		f.Logger.Debug("dropping icmp", zap.Stringer("flow", flow))
+		return true
+	}
+	// The packet's buffer is reused by the caller
+	req.data = append([]byte(nil), req.data...)
+	go f.forward(req, flow)
+	return true
+}
+
+// forward sends the echo request from a ping socket and writes the reply to the Stack.
+func (f *ICMPForwarder) forward(req echoRequest, flow Flow) {
+	logger := f.Logger.With(zap.Stringer("flow", flow), zap.Uint16("seq", req.seq))
+	logger.Debug("forwarding icmp")
+
+	network, address, proto := "udp4", "0.0.0.0", 1
+	var msgType, replyType icmp.Type = xipv4.ICMPTypeEcho, xipv4.ICMPTypeEchoReply
+	if req.netProto == ipv6.ProtocolNumber {
+		network, address, proto = "udp6", "::", 58
+		msgType, replyType = xipv6.ICMPTypeEchoRequest, xipv6.ICMPTypeEchoReply
+	}
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		logger.Warn("opening ping socket", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	// The ping socket replaces the identifier with its own, so replies are matched by sequence
+	b, err := (&icmp.Message{
+		Type: msgType,
+		Body: &icmp.Echo{ID: int(req.ident), Seq: int(req.seq), Data: req.data},
+	}).Marshal(nil)
+	if err != nil {
+		logger.Error("marshaling echo request", zap.Error(err))
+		return
+	}
+	if _, err = conn.WriteTo(b, &net.UDPAddr{IP: net.IP(req.dst)}); err != nil {
+		logger.Debug("sending echo request", zap.Error(err))
+		if reason, ok := unreachableReason(err); ok {
+			f.writeUnreachable(logger, req, reason)
+		}
+		return
+	}
+
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = defaultEchoTimeout
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := utils.GetBuf(16 * 1024)
+	defer utils.PutBuf(buf)
+	for {
+		nr, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			logger.Debug("waiting for echo reply", zap.Error(err))
+			return
+		}
+		msg, err := icmp.ParseMessage(proto, buf[:nr])
+		if err != nil || msg.Type != replyType {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || echo.Seq != int(req.seq) {
+			continue
+		}
+		reply := icmpPacket(req.netProto, req.dst, req.src, icmpEchoReply, 0, req.ident, req.seq, echo.Data)
+		if err = writePacket(f.Stack, req.netProto, req.src, reply); err != nil {
+			logger.Warn("writing echo reply", zap.Error(err))
+		}
+		return
+	}
+}
+
+// writeUnreachable writes a destination unreachable message about the echo request to the Stack.
+func (f *ICMPForwarder) writeUnreachable(logger *zap.Logger, req echoRequest, reason unreachable) {
+	// IPv4 errors only quote the IP header and the first 8 bytes of the packet
+	quote := echoRequestPacket(req)
+	if n := header.IPv4MinimumSize + header.ICMPv4MinimumSize; req.netProto == ipv4.ProtocolNumber && len(quote) > n {
+		quote = quote[:n]
+	}
+	pkt := icmpPacket(req.netProto, req.dst, req.src, icmpUnreachable, reason.code(req.netProto), 0, 0, quote)
+	if err := writePacket(f.Stack, req.netProto, req.src, pkt); err != nil {
+		logger.Warn("writing destination unreachable", zap.Error(err))
+	}
+}
+
+// parseEchoRequest returns the echo request in the IP packet, if it is one.
+func parseEchoRequest(pkt []byte) (echoRequest, bool) {
+	if len(pkt) == 0 {
+		return echoRequest{}, false
+	}
+	switch header.IPVersion(pkt) {
+	case header.IPv4Version:
+		ip := header.IPv4(pkt)
+		if !ip.IsValid(len(pkt)) || ip.TransportProtocol() != header.ICMPv4ProtocolNumber || ip.More() || ip.FragmentOffset() != 0 {
+			return echoRequest{}, false
+		}
+		h := header.ICMPv4(ip.Payload())
+		if len(h) < header.ICMPv4MinimumSize || h.Type() != header.ICMPv4Echo {
+			return echoRequest{}, false
+		}
+		return echoRequest{
+			netProto: ipv4.ProtocolNumber,
+			src:      ip.SourceAddress(),
+			dst:      ip.DestinationAddress(),
+			ident:    h.Ident(),
+			seq:      h.Sequence(),
+			data:     h.Payload(),
+		}, true
+	case header.IPv6Version:
+		ip := header.IPv6(pkt)
+		if !ip.IsValid(len(pkt)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber || header.IsV6MulticastAddress(ip.DestinationAddress()) {
+			return echoRequest{}, false
+		}
+		h := header.ICMPv6(ip.Payload())
+		if len(h) < header.ICMPv6EchoMinimumSize || h.Type() != header.ICMPv6EchoRequest {
+			return echoRequest{}, false
+		}
+		return echoRequest{
+			netProto: ipv6.ProtocolNumber,
+			src:      ip.SourceAddress(),
+			dst:      ip.DestinationAddress(),
+			ident:    h.Ident(),
+			seq:      h.Sequence(),
+			data:     h.Payload(),
+		}, true
+	default:
+		return echoRequest{}, false
+	}
+}
+
+// assigned returns whether the address is assigned to the NIC. Unlike Stack.CheckLocalAddress,
+// this ignores whether the NIC is spoofing or promiscuous.
+func assigned(s *stack.Stack, nicID tcpip.NICID, addr tcpip.Address) bool {
+	for _, a := range s.AllAddresses()[nicID] {
+		if a.AddressWithPrefix.Address == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// echoRequestPacket rebuilds the packet of the echo request, so it can be quoted by errors.
+func echoRequestPacket(req echoRequest) []byte {
+	return icmpPacket(req.netProto, req.src, req.dst, icmpEchoRequest, 0, req.ident, req.seq, req.data)
+}
+
+// icmpMessage is the type of an ICMP message, independent of the IP version.
+type icmpMessage uint8
+
+const (
+	icmpEchoRequest icmpMessage = iota
+	icmpEchoReply
+	icmpUnreachable
+)
+
+// v4 returns the ICMPv4 type of the message.
+func (m icmpMessage) v4() header.ICMPv4Type {
+	switch m {
+	case icmpEchoRequest:
+		return header.ICMPv4Echo
+	case icmpEchoReply:
+		return header.ICMPv4EchoReply
+	default:
+		return header.ICMPv4DstUnreachable
+	}
+}
+
+// v6 returns the ICMPv6 type of the message.
+func (m icmpMessage) v6() header.ICMPv6Type {
+	switch m {
+	case icmpEchoRequest:
+		return header.ICMPv6EchoRequest
+	case icmpEchoReply:
+		return header.ICMPv6EchoReply
+	default:
+		return header.ICMPv6DstUnreachable
+	}
+}
+
+// unreachable is the reason why a destination couldn't be reached.
+type unreachable uint8
+
+const (
+	unreachableNet unreachable = iota
+	unreachableHost
+	unreachablePort
+)
+
+// code returns the destination unreachable code of the reason.
+func (u unreachable) code(netProto tcpip.NetworkProtocolNumber) uint8 {
+	if netProto == ipv4.ProtocolNumber {
+		switch u {
+		case unreachableNet:
+			return uint8(header.ICMPv4NetUnreachable)
+		case unreachablePort:
+			return uint8(header.ICMPv4PortUnreachable)
+		default:
+			return uint8(header.ICMPv4HostUnreachable)
+		}
+	}
+	switch u {
+	case unreachableNet:
+		return uint8(header.ICMPv6NetworkUnreachable)
+	case unreachablePort:
+		return uint8(header.ICMPv6PortUnreachable)
+	default:
+		return uint8(header.ICMPv6AddressUnreachable)
+	}
+}
+
+// unreachableReason returns why dialing or sending to a destination failed, if it failed
+// because the destination is unreachable.
+func unreachableReason(err error) (unreachable, bool) {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return unreachablePort, true
+	case errors.Is(err, syscall.ENETUNREACH):
+		return unreachableNet, true
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ETIMEDOUT),
+		errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return unreachableHost, true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return unreachableHost, true
+	}
+	return 0, false
+}
+
+// writeFlowUnreachable writes a destination unreachable message about the flow with the ID to the
+// Stack. The message quotes the IP header and the ports of the flow's first packet, which is
+// enough for the requester's stack to find the flow's endpoint.
+func writeFlowUnreachable(s *stack.Stack, transProto tcpip.TransportProtocolNumber, id stack.TransportEndpointID, reason unreachable) error {
+	ports := make([]byte, 8)
+	ports[0], ports[1] = byte(id.RemotePort>>8), byte(id.RemotePort)
+	ports[2], ports[3] = byte(id.LocalPort>>8), byte(id.LocalPort)
+
+	var quote []byte
+	netProto := ipv4.ProtocolNumber
+	if len(id.LocalAddress) == header.IPv6AddressSize {
+		netProto = ipv6.ProtocolNumber
+		quote = make([]byte, header.IPv6MinimumSize, header.IPv6MinimumSize+len(ports))
+		header.IPv6(quote).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(ports)),
+			TransportProtocol: transProto,
+			HopLimit:          64,
+			SrcAddr:           id.RemoteAddress,
+			DstAddr:           id.LocalAddress,
+		})
+	} else {
+		quote = make([]byte, header.IPv4MinimumSize, header.IPv4MinimumSize+len(ports))
+		ip := header.IPv4(quote)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(header.IPv4MinimumSize + len(ports)),
+			TTL:         64,
+			Protocol:    uint8(transProto),
+			SrcAddr:     id.RemoteAddress,
+			DstAddr:     id.LocalAddress,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+	}
+	quote = append(quote, ports...)
+	pkt := icmpPacket(netProto, id.LocalAddress, id.RemoteAddress, icmpUnreachable, reason.code(netProto), 0, 0, quote)
+	return writePacket(s, netProto, id.RemoteAddress, pkt)
+}
+
+// icmpPacket returns an IP packet from src to dst that carries an ICMP message. The identifier
+// and sequence are only meaningful for echo messages.
+func icmpPacket(netProto tcpip.NetworkProtocolNumber, src, dst tcpip.Address, msg icmpMessage, code uint8, ident, seq uint16, payload []byte) []byte {
+	if netProto == ipv4.ProtocolNumber {
+		b := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(payload))
+		ip := header.IPv4(b)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(b)),
+			TTL:         64,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     src,
+			DstAddr:     dst,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		h := header.ICMPv4(ip.Payload())
+		h.SetType(msg.v4())
+		h.SetCode(header.ICMPv4Code(code))
+		h.SetIdent(ident)
+		h.SetSequence(seq)
+		copy(h.Payload(), payload)
+		h.SetChecksum(^header.Checksum(h, 0))
+		return b
+	}
+
+	b := make([]byte, header.IPv6MinimumSize+header.ICMPv6PayloadOffset+len(payload))
+	ip := header.IPv6(b)
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(b) - header.IPv6MinimumSize),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          64,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	})
+	h := header.ICMPv6(ip.Payload())
+	h.SetType(msg.v6())
+	h.SetCode(header.ICMPv6Code(code))
+	h.SetIdent(ident)
+	h.SetSequence(seq)
+	copy(h.Payload(), payload)
+	h.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: h, Src: src, Dst: dst}))
+	return b
+}
+
+// writePacket writes the IP packet to the NIC that the Stack routes its destination through.
+func writePacket(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, dst tcpip.Address, pkt []byte) error {
+	r, tcpErr := s.FindRoute(0, "", dst, netProto, false)
+	if tcpErr != nil {
+		return errors.New(tcpErr.String())
+	}
+	nicID := r.NICID()
+	r.Release()
+	if tcpErr = s.WriteRawPacket(nicID, netProto, bufferv2.MakeWithData(pkt)); tcpErr != nil {
+		return errors.New(tcpErr.String())
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package netstack
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestUnreachableReason(t *testing.T) {
+	dialErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	for _, tc := range []struct {
+		err    error
+		reason unreachable
+		ok     bool
+	}{
+		{dialErr(syscall.ECONNREFUSED), unreachablePort, true},
+		{dialErr(syscall.ENETUNREACH), unreachableNet, true},
+		{dialErr(syscall.EHOSTUNREACH), unreachableHost, true},
+		{dialErr(syscall.ETIMEDOUT), unreachableHost, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, unreachableHost, true},
+		{context.DeadlineExceeded, unreachableHost, true},
+		{dialErr(syscall.EACCES), 0, false},
+		{errors.New("other"), 0, false},
+	} {
+		reason, ok := unreachableReason(tc.err)
+		require.Equal(t, tc.ok, ok, tc.err.Error())
+		require.Equal(t, tc.reason, reason, tc.err.Error())
+	}
+}
@@ -0,0 +1,105 @@
+package netstack
+
+import (
+	"errors"
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"sync"
+)
+
+// ErrQueueFull is returned by ChannelLink.Write when the channel's outbound queue is full and
+// the packet was dropped. Like with a congested link, later packets may still be written.
+var ErrQueueFull = errors.New("link queue full")
+
+// ChannelLink is the netstack's side of a channel.Endpoint. Endpoint reads the packets that
+// the netstack writes to the channel and injects the packets that the netstack receives,
+// while ChannelLink does the opposite: it reads the packets that are injected into the channel
+// and writes packets to the channel's outbound queue. This lets a channel that something else
+// serves, such as a transport, be used as the LinkLayer of a vni.Interface.
+type ChannelLink struct {
+	ep        *channel.Endpoint
+	packets   chan []byte   // The packets injected into the channel, until they're read
+	done      chan struct{} // Closed once the link is closed
+	closeOnce sync.Once
+}
+
+// NewChannelLink attaches to the channel, which must not be attached to a netstack.
+func NewChannelLink(ep *channel.Endpoint) *ChannelLink {
+	l := &ChannelLink{
+		ep:      ep,
+		packets: make(chan []byte, 512),
+		done:    make(chan struct{}),
+	}
+	ep.Attach(channelDispatcher{l})
+	return l
+}
+
+// Read reads the next packet that was injected into the channel.
+func (l *ChannelLink) Read(p []byte) (int, error) {
+	select {
+	case b := <-l.packets:
+		return copy(p, b), nil
+	case <-l.done:
+		return 0, io.EOF
+	}
+}
+
+// Write adds the packet to the channel's outbound queue, or drops it and returns ErrQueueFull
+// if the queue is full.
+func (l *ChannelLink) Write(p []byte) (int, error) {
+	select {
+	case <-l.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// NewPacketBuffer takes ownership of the data, so making a copy is necessary
+	data := make([]byte, len(p))
+	copy(data, p)
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: bufferv2.MakeWithData(data),
+	})
+	var pkts stack.PacketBufferList
+	pkts.PushBack(pkt)
+	n, err := l.ep.WritePackets(pkts)
+	// The queue takes its own reference to the packets that it accepts
+	pkt.DecRef()
+	if err != nil {
+		return 0, errors.New(err.String())
+	}
+	if n == 0 {
+		return 0, ErrQueueFull
+	}
+	return len(p), nil
+}
+
+// Close stops reading from the channel. The channel itself stays open.
+func (l *ChannelLink) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// channelDispatcher receives the packets injected into a ChannelLink's channel.
+type channelDispatcher struct {
+	l *ChannelLink
+}
+
+func (d channelDispatcher) DeliverNetworkPacket(_ tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	b := pkt.ToBuffer()
+	select {
+	case d.l.packets <- b.Flatten():
+	case <-d.l.done:
+	default:
+		// Drop the packet like a full NIC queue would
+	}
+}
+
+func (d channelDispatcher) DeliverLinkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer, bool) {
+}
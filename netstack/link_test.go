@@ -0,0 +1,33 @@
+package netstack
+
+import (
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"testing"
+)
+
+func TestChannelLinkQueueFull(t *testing.T) {
+	ep := channel.New(2, 1500, "")
+	l := NewChannelLink(ep)
+	defer l.Close()
+	for i := byte(1); i <= 2; i++ {
+		n, err := l.Write([]byte{i})
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	}
+
+	// Packets that don't fit in the queue are dropped, and reported as such
+	n, err := l.Write([]byte{3})
+	require.ErrorIs(t, err, ErrQueueFull)
+	require.Zero(t, n)
+
+	for i := byte(1); i <= 2; i++ {
+		pkt := ep.Read()
+		require.NotNil(t, pkt)
+		require.Equal(t, []byte{i}, pkt.ToView().AsSlice())
+		pkt.DecRef()
+	}
+	require.Nil(t, ep.Read())
+	_, err = l.Write([]byte{4})
+	require.NoError(t, err)
+}
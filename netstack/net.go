@@ -0,0 +1,199 @@
+package netstack
+
+import (
+	"context"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// Net dials, listens and resolves names on a userspace network Stack, mirroring the net package
+// so that libraries that accept a dial function or a net.Listener can use the Stack. The
+// networks are "tcp", "tcp4", "tcp6", "udp", "udp4" and "udp6".
+type Net struct {
+	Stack    *stack.Stack
+	NIC      tcpip.NICID   // The NIC that sockets are bound to, or 0 to use the Stack's routing table
+	Resolver *net.Resolver // Looks up hostnames, defaults to net.DefaultResolver
+}
+
+// NewNet returns a Net that uses the Stack's routing table and the default resolver.
+func NewNet(s *stack.Stack) *Net {
+	return &Net{Stack: s}
+}
+
+// Dial connects to the address on the named network.
+func (n *Net) Dial(network, address string) (net.Conn, error) {
+	return n.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network. If the address has a hostname, each
+// of its addresses is tried in turn until one succeeds.
+func (n *Net) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	proto, family, err := splitNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := splitHostPort(proto, address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := n.lookup(ctx, family, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		remote := n.fullAddress(addr, port)
+		var conn net.Conn
+		if proto == "tcp" {
+			conn, err = gonet.DialContextTCP(ctx, n.Stack, remote, protocolNumber(addr))
+		} else {
+			conn, err = gonet.DialUDP(n.Stack, nil, &remote, protocolNumber(addr))
+		}
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+}
+
+// Listen listens for connections on the local address of a TCP network. Without a host, it
+// listens on every address of the Stack, and "tcp" accepts both IPv4 and IPv6 connections when
+// the Stack has IPv6.
+func (n *Net) Listen(network, address string) (net.Listener, error) {
+	proto, family, err := splitNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if proto != "tcp" {
+		return nil, net.UnknownNetworkError(network)
+	}
+	local, netProto, err := n.localAddress(proto, family, address)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := gonet.ListenTCP(n.Stack, local, netProto)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	return ln, nil
+}
+
+// ListenPacket listens for packets on the local address of a UDP network.
+func (n *Net) ListenPacket(network, address string) (net.PacketConn, error) {
+	proto, family, err := splitNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if proto != "udp" {
+		return nil, net.UnknownNetworkError(network)
+	}
+	local, netProto, err := n.localAddress(proto, family, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := gonet.DialUDP(n.Stack, &local, nil, netProto)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	return conn, nil
+}
+
+// LookupHost looks up the addresses of the host with the Resolver.
+func (n *Net) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return n.resolver().LookupHost(ctx, host)
+}
+
+func (n *Net) resolver() *net.Resolver {
+	if n.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return n.Resolver
+}
+
+// lookup returns the addresses of the host that belong to the family, which is "ip", "ip4" or
+// "ip6".
+func (n *Net) lookup(ctx context.Context, family, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		if (family == "ip4" && !addr.Is4()) || (family == "ip6" && !addr.Is6()) {
+			return nil, &net.AddrError{Err: "address has the wrong family", Addr: host}
+		}
+		return []netip.Addr{addr}, nil
+	}
+	addrs, err := n.resolver().LookupNetIP(ctx, family, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs, nil
+}
+
+// localAddress returns the address to bind to, and the network protocol of the socket.
+func (n *Net) localAddress(proto, family, address string) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
+	host, port, err := splitHostPort(proto, address)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, err
+	}
+	if host == "" {
+		// IPv6 sockets without an address accept IPv4 packets as well, but Stacks without IPv6
+		// need IPv4 sockets
+		netProto := ipv6.ProtocolNumber
+		if family == "ip4" || (family == "ip" && n.Stack.NetworkProtocolInstance(ipv6.ProtocolNumber) == nil) {
+			netProto = ipv4.ProtocolNumber
+		}
+		return tcpip.FullAddress{NIC: n.NIC, Port: port}, netProto, nil
+	}
+	addrs, err := n.lookup(context.Background(), family, host)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, err
+	}
+	return n.fullAddress(addrs[0], port), protocolNumber(addrs[0]), nil
+}
+
+func (n *Net) fullAddress(addr netip.Addr, port uint16) tcpip.FullAddress {
+	if addr.IsUnspecified() {
+		return tcpip.FullAddress{NIC: n.NIC, Port: port}
+	}
+	return tcpip.FullAddress{NIC: n.NIC, Addr: tcpip.Address(addr.AsSlice()), Port: port}
+}
+
+// splitNetwork splits a network such as "tcp4" into its protocol and address family.
+func splitNetwork(network string) (proto, family string, err error) {
+	switch network {
+	case "tcp", "udp":
+		return network, "ip", nil
+	case "tcp4", "udp4":
+		return network[:3], "ip4", nil
+	case "tcp6", "udp6":
+		return network[:3], "ip6", nil
+	default:
+		return "", "", net.UnknownNetworkError(network)
+	}
+}
+
+// splitHostPort splits an address such as "example.com:http" into its host and port. Named
+// ports are looked up in the host's services database.
+func splitHostPort(proto, address string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+		return host, uint16(p), nil
+	}
+	p, err := net.LookupPort(proto, port)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, uint16(p), nil
+}
@@ -0,0 +1,127 @@
+package netstack
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestStackPair connects two IPv4-only TestStacks, 10.0.0.1 and 10.0.0.2.
+func newTestStackPair(t *testing.T) (*TestStack, *TestStack) {
+	s1, err := NewTestStack(zap.NewNop(), "10.0.0.1", []string{"10.0.0.0/24"}, false)
+	require.NoError(t, err)
+	s2, err := NewTestStack(zap.NewNop(), "10.0.0.2", []string{"10.0.0.0/24"}, false)
+	require.NoError(t, err)
+	go MemoryPipe(s1.Endpoint, s2.Endpoint)
+	t.Cleanup(func() {
+		s1.Endpoint.Close()
+		s2.Endpoint.Close()
+		s1.Stack.Close()
+		s2.Stack.Close()
+	})
+	return s1, s2
+}
+
+func TestNetListen(t *testing.T) {
+	s1, s2 := newTestStackPair(t)
+	for _, address := range []string{":8080", "0.0.0.0:8081", "10.0.0.2:8082"} {
+		t.Run(address, func(t *testing.T) {
+			ln, err := s2.Net().Listen("tcp", address)
+			require.NoError(t, err)
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+
+			_, port, _ := net.SplitHostPort(ln.Addr().String())
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := s1.Net().DialContext(ctx, "tcp", net.JoinHostPort("10.0.0.2", port))
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			require.Equal(t, "ping", string(buf))
+		})
+	}
+
+	// The stack has no IPv6, so IPv6 networks can't be used
+	_, err := s2.Net().Listen("tcp6", ":8080")
+	require.Error(t, err)
+	_, err = s2.Net().Listen("udp", ":8080")
+	require.Error(t, err)
+}
+
+func TestNetListenPacket(t *testing.T) {
+	s1, s2 := newTestStackPair(t)
+	for _, address := range []string{":0", ":5353", "10.0.0.2:0"} {
+		t.Run(address, func(t *testing.T) {
+			pc, err := s2.Net().ListenPacket("udp", address)
+			require.NoError(t, err)
+			defer pc.Close()
+			go func() {
+				buf := make([]byte, 1500)
+				for {
+					n, addr, err := pc.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					_, _ = pc.WriteTo(buf[:n], addr)
+				}
+			}()
+
+			_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+			require.NotEqual(t, "0", port)
+			conn, err := s1.Net().Dial("udp", net.JoinHostPort("10.0.0.2", port))
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+			buf := make([]byte, 16)
+			n, err := conn.Read(buf)
+			require.NoError(t, err)
+			require.Equal(t, "ping", string(buf[:n]))
+		})
+	}
+	_, err := s2.Net().ListenPacket("tcp", ":0")
+	require.Error(t, err)
+}
+
+func TestNetDialContext(t *testing.T) {
+	s1, _ := newTestStackPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Nothing listens on the port, so the connection is refused
+	_, err := s1.Net().DialContext(ctx, "tcp", "10.0.0.2:9")
+	require.Error(t, err)
+	var opErr *net.OpError
+	require.ErrorAs(t, err, &opErr)
+	require.Equal(t, "dial", opErr.Op)
+
+	for _, tc := range []struct {
+		network, address string
+	}{
+		{"tcp6", "10.0.0.2:80"},
+		{"tcp4", "[fd00::1]:80"},
+		{"sctp", "10.0.0.2:80"},
+		{"tcp", "10.0.0.2"},
+	} {
+		_, err = s1.Net().DialContext(ctx, tc.network, tc.address)
+		require.Error(t, err, "%s %s", tc.network, tc.address)
+	}
+}
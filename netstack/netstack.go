@@ -54,8 +54,9 @@ func NewTestStack(logger *zap.Logger, nic string, routes []string, forwarding bo
 	if forwarding {
 		tcpFwd := TCPForwarder{
 			Logger: logger.Named("tcp-forwarder"),
+			Stack:  s,
 		}
-		s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcp.NewForwarder(s, 0, 5, tcpFwd.Handle).HandlePacket)
+		s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcp.NewForwarder(s, 0, MaxInFlight, tcpFwd.Handle).HandlePacket)
 
 		udpFwd := UDPForwarder{
 			Logger:  logger.Named("udp-forwarder"),
@@ -97,3 +98,8 @@ func NewTestStack(logger *zap.Logger, nic string, routes []string, forwarding bo
 		logger:   logger,
 	}, nil
 }
+
+// Net returns a Net that dials and listens on the test stack.
+func (t *TestStack) Net() *Net {
+	return NewNet(t.Stack)
+}
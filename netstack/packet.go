@@ -0,0 +1,34 @@
+package netstack
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"net/netip"
+)
+
+// PacketAddrs returns the source and destination addresses of the raw IPv4 or IPv6
+// packet. If the packet is too short or isn't an IP packet, ok is false.
+func PacketAddrs(p []byte) (src, dst netip.Addr, ok bool) {
+	if len(p) == 0 {
+		return src, dst, false
+	}
+	switch header.IPVersion(p) {
+	case header.IPv4Version:
+		if len(p) < header.IPv4MinimumSize {
+			return src, dst, false
+		}
+		h := header.IPv4(p)
+		src, _ = netip.AddrFromSlice([]byte(h.SourceAddress()))
+		dst, _ = netip.AddrFromSlice([]byte(h.DestinationAddress()))
+		return src, dst, true
+	case header.IPv6Version:
+		if len(p) < header.IPv6MinimumSize {
+			return src, dst, false
+		}
+		h := header.IPv6(p)
+		src, _ = netip.AddrFromSlice([]byte(h.SourceAddress()))
+		dst, _ = netip.AddrFromSlice([]byte(h.DestinationAddress()))
+		return src, dst, true
+	default:
+		return src, dst, false
+	}
+}
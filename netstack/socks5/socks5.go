@@ -0,0 +1,414 @@
+package netstacksocks5
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"github.com/clarkmcc/remotenetstack/netstack/vni"
+	"github.com/clarkmcc/remotenetstack/utils"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	socksVersion = 5
+	authVersion  = 1 // The version of the username/password subnegotiation
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	handshakeTimeout = 30 * time.Second
+	dialTimeout      = 30 * time.Second
+)
+
+// The reply codes of RFC 1928
+const (
+	repSucceeded          = 0x00
+	repGeneralFailure     = 0x01
+	repNetworkUnreachable = 0x03
+	repHostUnreachable    = 0x04
+	repConnectionRefused  = 0x05
+	repCommandUnsupported = 0x07
+	repAddressUnsupported = 0x08
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe once the Server is closed.
+var ErrServerClosed = errors.New("server closed")
+
+type Option func(*Config)
+
+// WithLogger sets the logger to use inside the server.
+func WithLogger(logger *zap.Logger) Option {
+	return func(config *Config) {
+		config.Logger = logger
+	}
+}
+
+// WithCredentials requires clients to authenticate with a username and password. It can be used
+// more than once to accept several users.
+func WithCredentials(username, password string) Option {
+	return func(config *Config) {
+		if config.Credentials == nil {
+			config.Credentials = map[string]string{}
+		}
+		config.Credentials[username] = password
+	}
+}
+
+// WithResolver sets the resolver that looks up the hostnames that clients connect to, instead
+// of the exit's DNS server.
+func WithResolver(resolver *net.Resolver) Option {
+	return func(config *Config) {
+		config.Resolver = resolver
+	}
+}
+
+type Config struct {
+	Logger      *zap.Logger
+	Credentials map[string]string // Usernames and their passwords, or nil to accept clients without authentication
+	Resolver    *net.Resolver     // Looks up hostnames, defaults to the resolver of the entrance's exit
+}
+
+// Server is a SOCKS5 proxy that connects its clients through an entrance interface. It supports
+// the CONNECT and UDP ASSOCIATE commands, and hostnames are resolved on the far side of the
+// tunnel.
+type Server struct {
+	logger      *zap.Logger
+	net         *netstack.Net
+	credentials map[string]string
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	mu      sync.Mutex
+	closers map[io.Closer]struct{} // The listeners and client connections of the server
+}
+
+// NewServer returns a SOCKS5 server that dials through the interface. Unless WithResolver is
+// used, hostnames are resolved with the DNS server of the interface's exit, which must have
+// DNS enabled. The server is closed when the interface shuts down.
+func NewServer(iface *vni.Interface, opts ...Option) (*Server, error) {
+	cfg := Config{
+		Logger: zap.NewNop(),
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.Resolver == nil {
+		resolver, err := iface.Resolver(netip.AddrPort{})
+		if err != nil {
+			return nil, err
+		}
+		cfg.Resolver = resolver
+	}
+	n := iface.Net()
+	n.Resolver = cfg.Resolver
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		logger:      cfg.Logger,
+		net:         n,
+		credentials: cfg.Credentials,
+		ctx:         ctx,
+		cancel:      cancel,
+		closers:     map[io.Closer]struct{}{},
+	}
+	go func() {
+		select {
+		case <-iface.Done():
+			_ = s.Close()
+		case <-ctx.Done():
+		}
+	}()
+	return s, nil
+}
+
+// ListenAndServe listens on the TCP address of the host and serves SOCKS5 clients until the
+// server is closed.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves the SOCKS5 clients that are accepted from the listener until accepting fails or
+// the server is closed. The listener is closed when Serve returns.
+func (s *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+	if !s.track(ln) {
+		return ErrServerClosed
+	}
+	defer s.untrack(ln)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops every listener of the server and closes the connections of its clients.
+func (s *Server) Close() error {
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.closers {
+		_ = c.Close()
+	}
+	return nil
+}
+
+// track adds the listener or connection to the ones that are closed with the server, unless the
+// server is already closed.
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.closers[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.closers, c)
+}
+
+// serveConn negotiates with the client and carries out its request.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+	logger := s.logger.With(zap.Stringer("client", conn.RemoteAddr()))
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := s.authenticate(conn); err != nil {
+		logger.Debug("authenticating client", zap.Error(err))
+		return
+	}
+	var req [3]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		logger.Debug("reading request", zap.Error(err))
+		return
+	}
+	if req[0] != socksVersion {
+		logger.Debug("unsupported socks version", zap.Uint8("version", req[0]))
+		return
+	}
+	host, port, err := readAddr(conn)
+	if err != nil {
+		logger.Debug("reading request address", zap.Error(err))
+		_ = writeReply(conn, repAddressUnsupported, netip.AddrPort{})
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	switch req[1] {
+	case cmdConnect:
+		s.connect(logger, conn, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	case cmdUDPAssociate:
+		s.associate(logger, conn)
+	default:
+		logger.Debug("unsupported command", zap.Uint8("command", req[1]))
+		_ = writeReply(conn, repCommandUnsupported, netip.AddrPort{})
+	}
+}
+
+// authenticate negotiates the authentication method with the client, and checks its username
+// and password if the server has credentials.
+func (s *Server) authenticate(conn net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion {
+		return fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	method := byte(methodNoAuth)
+	if s.credentials != nil {
+		method = methodUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		_, _ = conn.Write([]byte{socksVersion, methodNoAcceptable})
+		return errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+	if method == methodNoAuth {
+		return nil
+	}
+
+	// Username/password authentication as described in RFC 1929
+	var ver [2]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return err
+	}
+	if ver[0] != authVersion {
+		return fmt.Errorf("unsupported authentication version %d", ver[0])
+	}
+	username := make([]byte, ver[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return err
+	}
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+	expected, ok := s.credentials[string(username)]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), password) != 1 {
+		_, _ = conn.Write([]byte{authVersion, 1})
+		return fmt.Errorf("invalid credentials for user %q", username)
+	}
+	_, err := conn.Write([]byte{authVersion, 0})
+	return err
+}
+
+// connect dials the address through the tunnel and joins the connection with the client's.
+func (s *Server) connect(logger *zap.Logger, conn net.Conn, address string) {
+	logger = logger.With(zap.String("address", address))
+	ctx, cancel := context.WithTimeout(s.ctx, dialTimeout)
+	target, err := s.net.DialContext(ctx, "tcp", address)
+	cancel()
+	if err != nil {
+		logger.Debug("dialing target", zap.Error(err))
+		_ = writeReply(conn, replyCode(err), netip.AddrPort{})
+		return
+	}
+	defer target.Close()
+	if err = writeReply(conn, repSucceeded, addrPort(target.LocalAddr())); err != nil {
+		return
+	}
+	logger.Debug("forwarding connection")
+	utils.Join(conn, target)
+}
+
+// replyCode returns the reply that reports the error of a dial. The netstack only reports its
+// errors as strings, so they are matched by their messages.
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return repHostUnreachable
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "connection was refused"):
+		return repConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return repNetworkUnreachable
+	case strings.Contains(msg, "no route"), strings.Contains(msg, "timed out"), strings.Contains(msg, "canceled"):
+		return repHostUnreachable
+	default:
+		return repGeneralFailure
+	}
+}
+
+// readAddr reads an address and port in the format of RFC 1928. The host is either an IP
+// address or a hostname.
+func readAddr(r io.Reader) (string, uint16, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		b := make([]byte, 4)
+		if atyp[0] == atypIPv6 {
+			b = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", 0, err
+		}
+		addr, _ := netip.AddrFromSlice(b)
+		host = addr.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", 0, err
+		}
+		host = string(b)
+	default:
+		return "", 0, fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
+	}
+	return host, binary.BigEndian.Uint16(port[:]), nil
+}
+
+// appendAddr appends the address and port in the format of RFC 1928.
+func appendAddr(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		b = append(b, atypIPv4)
+	} else {
+		b = append(b, atypIPv6)
+	}
+	b = append(b, ip.AsSlice()...)
+	return append(b, byte(addr.Port()>>8), byte(addr.Port()))
+}
+
+// writeReply writes the reply to a request, with the address that the server bound.
+func writeReply(w io.Writer, rep byte, bound netip.AddrPort) error {
+	if !bound.IsValid() {
+		bound = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	}
+	_, err := w.Write(appendAddr([]byte{socksVersion, rep, 0}, bound))
+	return err
+}
+
+// addrPort returns the address and port of a TCP or UDP address.
+func addrPort(addr net.Addr) netip.AddrPort {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.AddrPort()
+	case *net.UDPAddr:
+		return addr.AddrPort()
+	default:
+		return netip.AddrPort{}
+	}
+}
@@ -0,0 +1,253 @@
+package netstacksocks5
+
+import (
+	"bytes"
+	"context"
+	"github.com/clarkmcc/remotenetstack/netstack/vni"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestReadAddr(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		host string
+		port uint16
+		err  string
+	}{
+		{"ipv4", []byte{atypIPv4, 192, 0, 2, 1, 0x1f, 0x90}, "192.0.2.1", 8080, ""},
+		{"ipv6", append(append([]byte{atypIPv6}, net.ParseIP("2001:db8::1")...), 0, 80), "2001:db8::1", 80, ""},
+		{"domain", append([]byte{atypDomain, 11}, "example.com\x01\xbb"...), "example.com", 443, ""},
+		{"unsupported", []byte{0x02, 0, 0}, "", 0, "unsupported address type 2"},
+		{"truncated address", []byte{atypIPv4, 192, 0}, "", 0, io.ErrUnexpectedEOF.Error()},
+		{"truncated domain", []byte{atypDomain, 11, 'e'}, "", 0, io.ErrUnexpectedEOF.Error()},
+		{"missing port", []byte{atypIPv4, 192, 0, 2, 1}, "", 0, io.EOF.Error()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			host, port, err := readAddr(bytes.NewReader(tc.b))
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.host, host)
+			require.Equal(t, tc.port, port)
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	credentials := map[string]string{"user": "secret"}
+	userPass := func(user, password string) []byte {
+		b := append([]byte{authVersion, byte(len(user))}, user...)
+		b = append(b, byte(len(password)))
+		return append(b, password...)
+	}
+	for _, tc := range []struct {
+		name        string
+		credentials map[string]string
+		request     []byte // Sent by the client
+		reply       []byte // Expected from the server
+		err         string
+	}{
+		{"no auth", nil, []byte{socksVersion, 1, methodNoAuth}, []byte{socksVersion, methodNoAuth}, ""},
+		{"no auth not offered", nil, []byte{socksVersion, 1, methodUserPass}, []byte{socksVersion, methodNoAcceptable}, "no acceptable authentication method"},
+		{"auth not offered", credentials, []byte{socksVersion, 1, methodNoAuth}, []byte{socksVersion, methodNoAcceptable}, "no acceptable authentication method"},
+		{"valid credentials", credentials, append([]byte{socksVersion, 2, methodNoAuth, methodUserPass}, userPass("user", "secret")...),
+			[]byte{socksVersion, methodUserPass, authVersion, 0}, ""},
+		{"invalid password", credentials, append([]byte{socksVersion, 1, methodUserPass}, userPass("user", "wrong")...),
+			[]byte{socksVersion, methodUserPass, authVersion, 1}, `invalid credentials for user "user"`},
+		{"unknown user", credentials, append([]byte{socksVersion, 1, methodUserPass}, userPass("other", "secret")...),
+			[]byte{socksVersion, methodUserPass, authVersion, 1}, `invalid credentials for user "other"`},
+		{"unsupported auth version", credentials, []byte{socksVersion, 1, methodUserPass, 2, 0, 0},
+			[]byte{socksVersion, methodUserPass}, "unsupported authentication version 2"},
+		{"unsupported socks version", nil, []byte{4, 1, methodNoAuth}, nil, "unsupported socks version 4"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			s := &Server{credentials: tc.credentials}
+			errs := make(chan error, 1)
+			go func() {
+				errs <- s.authenticate(server)
+				_ = server.Close()
+			}()
+			go func() {
+				_, _ = client.Write(tc.request)
+			}()
+			reply, err := io.ReadAll(client)
+			require.NoError(t, err)
+			require.Equal(t, tc.reply, append([]byte(nil), reply...))
+			err = <-errs
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+// hostAddr returns an IPv4 global unicast address of the host, since the netstack drops packets
+// to loopback addresses.
+func hostAddr(t *testing.T) netip.Addr {
+	addrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && n.IP.IsGlobalUnicast() {
+			addr, _ := netip.AddrFromSlice(n.IP.To4())
+			return addr
+		}
+	}
+	t.Skip("host has no global unicast address")
+	return netip.Addr{}
+}
+
+// testDNS answers A queries for the names with their addresses. Queries for names that are
+// blocked aren't answered until the channel is closed.
+type testDNS struct {
+	addr    net.Addr
+	names   map[string]netip.Addr
+	blocked map[string]chan struct{}
+	queries atomic.Int64
+}
+
+func newTestDNS(t *testing.T, names map[string]netip.Addr, blocked map[string]chan struct{}) *testDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	d := &testDNS{addr: conn.LocalAddr(), names: names, blocked: blocked}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := append([]byte(nil), buf[:n]...)
+			go func() {
+				if res := d.answer(query); res != nil {
+					_, _ = conn.WriteTo(res, from)
+				}
+			}()
+		}
+	}()
+	return d
+}
+
+func (d *testDNS) answer(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	if q.Type == dnsmessage.TypeA {
+		d.queries.Inc()
+	}
+	if blocked, ok := d.blocked[q.Name.String()]; ok {
+		<-blocked
+	}
+	addr, ok := d.names[q.Name.String()]
+	res := dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true}
+	if !ok {
+		res.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, res)
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	_ = b.StartAnswers()
+	if ok && q.Type == dnsmessage.TypeA {
+		_ = b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: addr.As4()})
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+// resolver returns a resolver that sends its queries to the server.
+func (d *testDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", d.addr.String())
+		},
+	}
+}
+
+// newTestServer serves SOCKS5 clients through an entrance whose exit exposes the host address.
+func newTestServer(t *testing.T, addr netip.Addr, opts ...Option) string {
+	l1, l2 := net.Pipe()
+	ex, err := vni.New(vni.Config{Mode: vni.Exit, LinkLayer: l2})
+	require.NoError(t, err)
+	t.Cleanup(ex.Stop)
+	require.NoError(t, ex.ExposeRoutes([]string{netip.PrefixFrom(addr, 32).String()}))
+	en, err := vni.New(vni.Config{Mode: vni.Entrance, LinkLayer: l1})
+	require.NoError(t, err)
+	t.Cleanup(en.Stop)
+
+	s, err := NewServer(en, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = s.Serve(ln) }()
+	return ln.Addr().String()
+}
+
+func TestConnect(t *testing.T) {
+	addr := hostAddr(t)
+	ln, err := net.Listen("tcp", netip.AddrPortFrom(addr, 0).String())
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	dns := newTestDNS(t, map[string]netip.Addr{"echo.test.": addr}, nil)
+	server := newTestServer(t, addr, WithResolver(dns.resolver()), WithCredentials("user", "secret"))
+
+	// Both addresses and hostnames, which are resolved by the server, can be connected to
+	dialer, err := proxy.SOCKS5("tcp", server, &proxy.Auth{User: "user", Password: "secret"}, proxy.Direct)
+	require.NoError(t, err)
+	for _, host := range []string{addr.String(), "echo.test"} {
+		conn, err := dialer.Dial("tcp", net.JoinHostPort(host, port))
+		require.NoError(t, err, host)
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(buf))
+		_ = conn.Close()
+	}
+
+	// Unknown hostnames and wrong credentials are rejected
+	_, err = dialer.Dial("tcp", net.JoinHostPort("missing.test", port))
+	require.ErrorContains(t, err, "host unreachable")
+	dialer, err = proxy.SOCKS5("tcp", server, &proxy.Auth{User: "user", Password: "wrong"}, proxy.Direct)
+	require.NoError(t, err)
+	_, err = dialer.Dial("tcp", net.JoinHostPort(addr.String(), port))
+	require.Error(t, err)
+}
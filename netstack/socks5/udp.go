@@ -0,0 +1,224 @@
+package netstacksocks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	maxNames   = 256         // How many hostnames an association remembers the address of
+	nameTTL    = time.Minute // How long the address of a hostname is remembered
+	maxLookups = 8           // How many hostnames an association looks up at the same time
+)
+
+// name is the address of a hostname that an association looked up.
+type name struct {
+	addr    netip.Addr
+	expires time.Time
+}
+
+// association relays the UDP datagrams of a client through the tunnel.
+type association struct {
+	server   *Server
+	logger   *zap.Logger
+	relay    *net.UDPConn    // The host socket that the client sends its datagrams to
+	tunnel   net.PacketConn  // The netstack socket that datagrams are sent through the tunnel from
+	clientIP netip.Addr      // Datagrams from other addresses are dropped
+	ctx      context.Context // Canceled once the association ends, which aborts lookups
+	lookups  chan struct{}   // Holds a token for every lookup in progress
+
+	mu     sync.Mutex
+	client netip.AddrPort  // The address that the client sends its datagrams from, once it has sent one
+	names  map[string]name // The addresses of the hostnames that were looked up
+}
+
+// associate relays the client's UDP datagrams through the tunnel until the client closes its
+// control connection, as described in section 7 of RFC 1928. Only datagrams from the address
+// of the control connection are relayed.
+func (s *Server) associate(logger *zap.Logger, conn net.Conn) {
+	local := addrPort(conn.LocalAddr())
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.Addr().AsSlice()})
+	if err != nil {
+		logger.Warn("listening for datagrams", zap.Error(err))
+		_ = writeReply(conn, repGeneralFailure, netip.AddrPort{})
+		return
+	}
+	defer relay.Close()
+	tunnel, err := s.net.ListenPacket("udp", ":0")
+	if err != nil {
+		logger.Warn("listening for datagrams on the netstack", zap.Error(err))
+		_ = writeReply(conn, repGeneralFailure, netip.AddrPort{})
+		return
+	}
+	defer tunnel.Close()
+	if err = writeReply(conn, repSucceeded, addrPort(relay.LocalAddr())); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	a := &association{
+		server:   s,
+		logger:   logger.With(zap.Stringer("relay", relay.LocalAddr())),
+		relay:    relay,
+		tunnel:   tunnel,
+		clientIP: addrPort(conn.RemoteAddr()).Addr().Unmap(),
+		ctx:      ctx,
+		lookups:  make(chan struct{}, maxLookups),
+		names:    map[string]name{},
+	}
+	a.logger.Debug("relaying datagrams")
+	go a.fromClient()
+	go a.toClient()
+
+	// The association lasts as long as the control connection, which carries nothing else
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// fromClient sends the datagrams of the client through the tunnel until the relay is closed.
+// Fragmented datagrams aren't supported and are dropped. Datagrams to hostnames whose address
+// isn't known yet are sent once the hostname is looked up, without holding up the others.
+func (a *association) fromClient() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		if from.Addr().Unmap() != a.clientIP {
+			continue
+		}
+		a.mu.Lock()
+		a.client = from
+		a.mu.Unlock()
+
+		if n < 3 || buf[2] != 0 {
+			a.logger.Debug("dropping fragmented datagram")
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		host, port, err := readAddr(r)
+		if err != nil {
+			a.logger.Debug("reading datagram address", zap.Error(err))
+			continue
+		}
+		payload := buf[n-r.Len() : n]
+		if addr, ok := a.cached(host); ok {
+			a.send(payload, netip.AddrPortFrom(addr, port))
+			continue
+		}
+
+		// Datagrams are dropped rather than queued when too many hostnames are being looked up,
+		// like they would be by a congested network
+		select {
+		case a.lookups <- struct{}{}:
+		default:
+			a.logger.Debug("dropping datagram while looking up other hostnames", zap.String("host", host))
+			continue
+		}
+		payload = append([]byte(nil), payload...)
+		go func() {
+			defer func() { <-a.lookups }()
+			addr, err := a.lookup(host)
+			if err != nil {
+				a.logger.Debug("resolving datagram address", zap.String("host", host), zap.Error(err))
+				return
+			}
+			a.send(payload, netip.AddrPortFrom(addr, port))
+		}()
+	}
+}
+
+// send sends the payload of a datagram through the tunnel.
+func (a *association) send(payload []byte, to netip.AddrPort) {
+	addr := net.UDPAddrFromAddrPort(to)
+	if _, err := a.tunnel.WriteTo(payload, addr); err != nil {
+		a.logger.Debug("sending datagram", zap.Stringer("to", addr), zap.Error(err))
+	}
+}
+
+// toClient sends the datagrams that arrive through the tunnel to the client until the tunnel
+// socket is closed.
+func (a *association) toClient() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.tunnel.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		client := a.client
+		a.mu.Unlock()
+		if !client.IsValid() {
+			continue
+		}
+		src := addrPort(from)
+		msg := appendAddr([]byte{0, 0, 0}, netip.AddrPortFrom(src.Addr().Unmap(), src.Port()))
+		if _, err = a.relay.WriteToUDPAddrPort(append(msg, buf[:n]...), client); err != nil {
+			a.logger.Debug("sending datagram to client", zap.Error(err))
+		}
+	}
+}
+
+// cached returns the address of the host if it's an IP address, or a hostname that was looked
+// up less than nameTTL ago.
+func (a *association) cached(host string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap(), true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n, ok := a.names[host]
+	if !ok || time.Now().After(n.expires) {
+		return netip.Addr{}, false
+	}
+	return n.addr, true
+}
+
+// lookup looks up the address of the hostname through the tunnel, and remembers it for nameTTL.
+// Once maxNames hostnames are remembered, the expired ones are forgotten, or an arbitrary one if
+// none have expired.
+func (a *association) lookup(host string) (netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(a.ctx, dialTimeout)
+	defer cancel()
+	addrs, err := a.server.net.LookupHost(ctx, host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, s := range addrs {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			continue
+		}
+		a.remember(host, addr.Unmap(), time.Now())
+		return addr.Unmap(), nil
+	}
+	return netip.Addr{}, fmt.Errorf("no addresses for %s", host)
+}
+
+// remember remembers the address of the hostname, which was looked up at the time.
+func (a *association) remember(host string, addr netip.Addr, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.names[host]; !ok && len(a.names) >= maxNames {
+		for h, n := range a.names {
+			if now.After(n.expires) {
+				delete(a.names, h)
+			}
+		}
+		for h := range a.names {
+			if len(a.names) < maxNames {
+				break
+			}
+			delete(a.names, h)
+		}
+	}
+	a.names[host] = name{addr: addr, expires: now.Add(nameTTL)}
+}
@@ -0,0 +1,170 @@
+package netstacksocks5
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// udpAssociate asks the server to relay datagrams, and returns the control connection along
+// with a socket that's connected to the relay.
+func udpAssociate(t *testing.T, server string) (net.Conn, *net.UDPConn) {
+	conn, err := net.Dial("tcp", server)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte{socksVersion, 1, methodNoAuth})
+	require.NoError(t, err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(conn, method)
+	require.NoError(t, err)
+	require.Equal(t, []byte{socksVersion, methodNoAuth}, method)
+	_, err = conn.Write(appendAddr([]byte{socksVersion, cmdUDPAssociate, 0}, netip.AddrPortFrom(netip.IPv4Unspecified(), 0)))
+	require.NoError(t, err)
+	reply := make([]byte, 3)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, []byte{socksVersion, repSucceeded, 0}, reply)
+	host, port, err := readAddr(conn)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Time{}))
+
+	relay, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(host), port)))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = relay.Close() })
+	return conn, relay
+}
+
+// sendDatagram sends the payload to the host through the relay.
+func sendDatagram(t *testing.T, relay *net.UDPConn, host string, port uint16, payload string) {
+	msg := []byte{0, 0, 0}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		msg = appendAddr(msg, netip.AddrPortFrom(addr, port))
+	} else {
+		msg = append(append([]byte{0, 0, 0, atypDomain, byte(len(host))}, host...), byte(port>>8), byte(port))
+	}
+	_, err := relay.Write(append(msg, payload...))
+	require.NoError(t, err)
+}
+
+// readDatagram reads the next datagram from the relay, and returns its source and payload.
+func readDatagram(t *testing.T, relay *net.UDPConn) (netip.AddrPort, string) {
+	require.NoError(t, relay.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 1500)
+	n, err := relay.Read(buf)
+	require.NoError(t, err)
+	require.Greater(t, n, 3)
+	r := bytes.NewReader(buf[3:n])
+	host, port, err := readAddr(r)
+	require.NoError(t, err)
+	return netip.AddrPortFrom(netip.MustParseAddr(host), port), string(buf[n-r.Len() : n])
+}
+
+// udpEcho listens for UDP datagrams on the address and sends them back.
+func udpEcho(t *testing.T, addr netip.Addr) netip.AddrPort {
+	conn, err := net.ListenPacket("udp", netip.AddrPortFrom(addr, 0).String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], from)
+		}
+	}()
+	return addrPort(conn.LocalAddr())
+}
+
+func TestUDPAssociate(t *testing.T) {
+	addr := hostAddr(t)
+	echo := udpEcho(t, addr)
+	dns := newTestDNS(t, map[string]netip.Addr{"echo.test.": addr}, nil)
+	server := newTestServer(t, addr, WithResolver(dns.resolver()))
+	_, relay := udpAssociate(t, server)
+
+	// Replies come from the address of the echo server, whether it was sent to by address or
+	// by hostname
+	sendDatagram(t, relay, addr.String(), echo.Port(), "ping")
+	from, payload := readDatagram(t, relay)
+	require.Equal(t, echo, from)
+	require.Equal(t, "ping", payload)
+	for i := 0; i < 3; i++ {
+		sendDatagram(t, relay, "echo.test", echo.Port(), fmt.Sprint("pong", i))
+		from, payload = readDatagram(t, relay)
+		require.Equal(t, echo, from)
+		require.Equal(t, fmt.Sprint("pong", i), payload)
+	}
+
+	// The hostname is only looked up once
+	require.Equal(t, int64(1), dns.queries.Load())
+}
+
+func TestUDPAssociateLooksUpWithoutBlocking(t *testing.T) {
+	addr := hostAddr(t)
+	echo := udpEcho(t, addr)
+	release := make(chan struct{})
+	dns := newTestDNS(t, map[string]netip.Addr{"slow.test.": addr}, map[string]chan struct{}{"slow.test.": release})
+	server := newTestServer(t, addr, WithResolver(dns.resolver()))
+	_, relay := udpAssociate(t, server)
+
+	// Datagrams to other destinations are relayed while the hostname is looked up
+	sendDatagram(t, relay, "slow.test", echo.Port(), "slow")
+	require.Eventually(t, func() bool {
+		return dns.queries.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	sendDatagram(t, relay, addr.String(), echo.Port(), "fast")
+	_, payload := readDatagram(t, relay)
+	require.Equal(t, "fast", payload)
+
+	// And the datagram to the hostname is sent once it's resolved
+	close(release)
+	_, payload = readDatagram(t, relay)
+	require.Equal(t, "slow", payload)
+}
+
+func TestAssociationNames(t *testing.T) {
+	a := &association{names: map[string]name{}}
+	addr := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+
+	// Addresses are used as they are, and hostnames until they expire
+	cached, ok := a.cached("::ffff:192.0.2.1")
+	require.True(t, ok)
+	require.Equal(t, addr, cached)
+	_, ok = a.cached("example.com")
+	require.False(t, ok)
+	a.remember("example.com", addr, now)
+	cached, ok = a.cached("example.com")
+	require.True(t, ok)
+	require.Equal(t, addr, cached)
+	a.remember("expired.com", addr, now.Add(-2*nameTTL))
+	_, ok = a.cached("expired.com")
+	require.False(t, ok)
+
+	// Expired hostnames are forgotten first once there are too many
+	for i := len(a.names); i < maxNames; i++ {
+		a.remember(fmt.Sprintf("host%d.com", i), addr, now)
+	}
+	require.Len(t, a.names, maxNames)
+	a.remember("new.com", addr, now)
+	require.Len(t, a.names, maxNames)
+	require.NotContains(t, a.names, "expired.com")
+	require.Contains(t, a.names, "new.com")
+
+	// And arbitrary ones when none have expired
+	a.remember("newer.com", addr, now)
+	require.Len(t, a.names, maxNames)
+	require.Contains(t, a.names, "newer.com")
+
+	// Hostnames that are looked up again don't make room
+	a.remember("newer.com", addr, now)
+	require.Len(t, a.names, maxNames)
+}
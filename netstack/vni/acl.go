@@ -0,0 +1,175 @@
+package vni
+
+import (
+	"fmt"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Action is what an ACL does with the flows that a Rule matches.
+type Action uint8
+
+const (
+	Deny Action = iota
+	Allow
+)
+
+func (a Action) String() string {
+	switch a {
+	case Deny:
+		return "deny"
+	case Allow:
+		return "allow"
+	default:
+		return "unknown"
+	}
+}
+
+func (a Action) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Action) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "deny":
+		*a = Deny
+	case "allow":
+		*a = Allow
+	default:
+		return fmt.Errorf("invalid action %q", b)
+	}
+	return nil
+}
+
+// PortRange is an inclusive range of ports. Its text form is either a single port, such as
+// "443", or a range, such as "8000-8999".
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// Contains returns whether the port is in the range.
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.First && port <= r.Last
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(int(r.First))
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+func (r PortRange) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *PortRange) UnmarshalText(b []byte) error {
+	first, last, ok := strings.Cut(string(b), "-")
+	if !ok {
+		last = first
+	}
+	f, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port range %q", b)
+	}
+	l, err := strconv.ParseUint(last, 10, 16)
+	if err != nil || l < f {
+		return fmt.Errorf("invalid port range %q", b)
+	}
+	r.First, r.Last = uint16(f), uint16(l)
+	return nil
+}
+
+// Rule matches flows by their source tunnel address, destination, protocol and destination
+// port. Empty fields match every flow.
+type Rule struct {
+	Action       Action         `json:"action"`
+	Sources      []netip.Prefix `json:"sources,omitempty"`      // Prefixes of the tunnel addresses that flows come from
+	Destinations []netip.Prefix `json:"destinations,omitempty"` // Prefixes of the addresses that flows go to
+	Protocol     string         `json:"protocol,omitempty"`     // "tcp", "udp" or "icmp"
+	Ports        []PortRange    `json:"ports,omitempty"`        // Destination ports, rules with ports never match ICMP flows
+}
+
+// Matches returns whether the rule matches the flow.
+func (r Rule) Matches(f netstack.Flow) bool {
+	if r.Protocol != "" && r.Protocol != f.Protocol {
+		return false
+	}
+	if len(r.Sources) > 0 && !containsAddr(r.Sources, f.Source.Addr()) {
+		return false
+	}
+	if len(r.Destinations) > 0 && !containsAddr(r.Destinations, f.Destination.Addr()) {
+		return false
+	}
+	if len(r.Ports) == 0 {
+		return true
+	}
+	if f.Protocol == "icmp" {
+		return false
+	}
+	for _, p := range r.Ports {
+		if p.Contains(f.Destination.Port()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL decides which flows exits and peers forward. Rules are evaluated in order and the first
+// rule that matches a flow decides what happens to it. Flows that no rule matches get the
+// Default action. ACLs must not be modified once they're passed to an Interface.
+type ACL struct {
+	Rules   []Rule `json:"rules"`
+	Default Action `json:"default"`
+}
+
+// Evaluate returns the action for the flow, along with the index of the rule that matched it
+// or -1 if the default action was used.
+func (a *ACL) Evaluate(f netstack.Flow) (Action, int) {
+	for i, r := range a.Rules {
+		if r.Matches(f) {
+			return r.Action, i
+		}
+	}
+	return a.Default, -1
+}
+
+// Validate checks that the rules are well-formed.
+func (a *ACL) Validate() error {
+	for i, r := range a.Rules {
+		if r.Action != Allow && r.Action != Deny {
+			return fmt.Errorf("rule %d: invalid action", i)
+		}
+		if r.Protocol != "" && r.Protocol != "tcp" && r.Protocol != "udp" && r.Protocol != "icmp" {
+			return fmt.Errorf("rule %d: invalid protocol %q", i, r.Protocol)
+		}
+		for _, p := range append(append([]netip.Prefix(nil), r.Sources...), r.Destinations...) {
+			if !p.IsValid() {
+				return fmt.Errorf("rule %d: invalid prefix", i)
+			}
+		}
+		for _, p := range r.Ports {
+			if p.Last < p.First {
+				return fmt.Errorf("rule %d: invalid port range %s", i, p)
+			}
+		}
+	}
+	if a.Default != Allow && a.Default != Deny {
+		return fmt.Errorf("invalid default action")
+	}
+	return nil
+}
+
+// containsAddr returns whether one of the prefixes contains the address.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
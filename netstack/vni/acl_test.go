@@ -0,0 +1,160 @@
+package vni
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func flow(protocol, src, dst string) netstack.Flow {
+	return netstack.Flow{
+		Protocol:    protocol,
+		Source:      netip.MustParseAddrPort(src),
+		Destination: netip.MustParseAddrPort(dst),
+	}
+}
+
+func TestACLEvaluate(t *testing.T) {
+	acl := &ACL{
+		Rules: []Rule{
+			// 0: A single host is denied before its network is allowed
+			{Action: Deny, Destinations: []netip.Prefix{netip.MustParsePrefix("10.1.2.3/32")}},
+			// 1
+			{Action: Allow, Destinations: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}, Protocol: "tcp", Ports: []PortRange{{443, 443}, {8000, 8999}}},
+			// 2
+			{Action: Allow, Sources: []netip.Prefix{netip.MustParsePrefix("100.64.1.0/24"), netip.MustParsePrefix("fd00:1::/64")}},
+			// 3
+			{Action: Allow, Protocol: "udp", Ports: []PortRange{{53, 53}}},
+			// 4: Rules with ports never match ICMP
+			{Action: Allow, Ports: []PortRange{{0, 65535}}},
+		},
+		Default: Deny,
+	}
+	require.NoError(t, acl.Validate())
+	for _, tc := range []struct {
+		name   string
+		flow   netstack.Flow
+		action Action
+		rule   int
+	}{
+		{"first matching rule wins", flow("tcp", "100.64.1.2:1000", "10.1.2.3:443"), Deny, 0},
+		{"port", flow("tcp", "100.64.0.2:1000", "10.1.0.1:443"), Allow, 1},
+		{"first port of range", flow("tcp", "100.64.0.2:1000", "10.1.0.1:8000"), Allow, 1},
+		{"last port of range", flow("tcp", "100.64.0.2:1000", "10.1.0.1:8999"), Allow, 1},
+		{"after port range", flow("tcp", "100.64.0.2:1000", "10.1.0.1:9000"), Allow, 4},
+		{"protocol", flow("udp", "100.64.0.2:1000", "10.1.0.1:443"), Allow, 4},
+		{"source", flow("udp", "100.64.1.2:1000", "192.0.2.1:123"), Allow, 2},
+		{"ipv6 source", flow("tcp", "[fd00:1::2]:1000", "[2001:db8::1]:80"), Allow, 2},
+		{"ipv4-mapped source", flow("icmp", "[::ffff:100.64.1.2]:0", "192.0.2.1:0"), Allow, 2},
+		{"udp port", flow("udp", "100.64.0.2:1000", "192.0.2.1:53"), Allow, 3},
+		{"icmp doesn't match ports", flow("icmp", "100.64.0.2:0", "10.1.0.1:0"), Deny, -1},
+		{"icmp to a denied host", flow("icmp", "100.64.1.2:0", "10.1.2.3:0"), Deny, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			action, rule := acl.Evaluate(tc.flow)
+			require.Equal(t, tc.action, action)
+			require.Equal(t, tc.rule, rule)
+		})
+	}
+
+	// Without rules, the default action applies
+	action, rule := (&ACL{Default: Allow}).Evaluate(flow("tcp", "100.64.0.2:1000", "10.1.0.1:443"))
+	require.Equal(t, Allow, action)
+	require.Equal(t, -1, rule)
+}
+
+func TestACLValidate(t *testing.T) {
+	for _, acl := range []*ACL{
+		{Default: 2},
+		{Rules: []Rule{{Action: 2}}},
+		{Rules: []Rule{{Protocol: "sctp"}}},
+		{Rules: []Rule{{Sources: []netip.Prefix{{}}}}},
+		{Rules: []Rule{{Destinations: []netip.Prefix{{}}}}},
+		{Rules: []Rule{{Ports: []PortRange{{443, 80}}}}},
+	} {
+		require.Error(t, acl.Validate())
+	}
+}
+
+func TestACLJSON(t *testing.T) {
+	var acl ACL
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"rules": [{"action": "allow", "destinations": ["10.0.0.0/8"], "protocol": "tcp", "ports": ["22", "8000-8999"]}],
+		"default": "deny"
+	}`), &acl))
+	require.Equal(t, ACL{
+		Rules: []Rule{{
+			Action:       Allow,
+			Destinations: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			Protocol:     "tcp",
+			Ports:        []PortRange{{22, 22}, {8000, 8999}},
+		}},
+		Default: Deny,
+	}, acl)
+	b, err := json.Marshal(acl)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"rules": [{"action": "allow", "destinations": ["10.0.0.0/8"], "protocol": "tcp", "ports": ["22", "8000-8999"]}],
+		"default": "deny"
+	}`, string(b))
+
+	for _, s := range []string{`{"default": "drop"}`, `{"rules": [{"ports": ["80-22"]}]}`, `{"rules": [{"ports": ["http"]}]}`, `{"rules": [{"ports": ["65536"]}]}`} {
+		require.Error(t, json.Unmarshal([]byte(s), &acl), s)
+	}
+}
+
+func TestExitACL(t *testing.T) {
+	addr := hostAddr(t, false)
+	ln, err := net.Listen("tcp", netip.AddrPortFrom(addr, 0).String())
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	echo := udpEcho(t, addr)
+	en, ex := newTestPair(t, Config{}, Config{ACL: &ACL{Default: Deny}}, netip.PrefixFrom(addr, 32).String())
+
+	dial := func(network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return en.Net().DialContext(ctx, network, address)
+	}
+
+	// Denied connections are reset rather than left to time out, and denied datagrams are dropped
+	start := time.Now()
+	_, err = dial("tcp", ln.Addr().String())
+	require.ErrorContains(t, err, "refused")
+	require.Less(t, time.Since(start), time.Second)
+	conn, err := dial("udp", echo.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, err = conn.Read(make([]byte, 4))
+	require.Error(t, err)
+
+	// Replacing the ACL allows the UDP flow, but not TCP
+	require.NoError(t, ex.SetACL(&ACL{Rules: []Rule{{Action: Allow, Protocol: "udp"}}}))
+	_, err = dial("tcp", ln.Addr().String())
+	require.Error(t, err)
+	requireEcho(t, conn, []byte("ping"))
+	require.Error(t, ex.SetACL(&ACL{Default: 2}))
+
+	// And removing it allows every flow to the exposed routes
+	require.NoError(t, ex.SetACL(nil))
+	tcpConn, err := dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	_ = tcpConn.Close()
+}
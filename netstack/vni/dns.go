@@ -0,0 +1,61 @@
+package vni
+
+import (
+	"errors"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"net"
+	"net/netip"
+)
+
+// DNSServer is the address that exits answer DNS queries on when DNS is enabled. Like the
+// LeaseServer, it's added to the NIC of the exit, and entrances reach it through their linkLayer.
+var DNSServer = netip.MustParseAddrPort("169.254.0.1:53")
+
+// serveDNS answers the DNS queries sent to the DNSServer, over UDP and TCP, using the exit
+// host's resolver.
+func (v *Interface) serveDNS() error {
+	if err := v.addServerAddress(DNSServer.Addr()); err != nil {
+		return err
+	}
+	addr := tcpip.FullAddress{
+		NIC:  v.nicId,
+		Addr: tcpip.Address(DNSServer.Addr().AsSlice()),
+		Port: DNSServer.Port(),
+	}
+	conn, err := gonet.DialUDP(v.Stack, &addr, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		return err
+	}
+	ln, err := gonet.ListenTCP(v.Stack, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	fwd := &netstack.DNSForwarder{
+		Logger: v.logger.Named("dns-forwarder"),
+	}
+	go func() {
+		<-v.ctx.Done()
+		_ = conn.Close()
+		_ = ln.Close()
+	}()
+	go fwd.ServeUDP(conn)
+	go fwd.ServeTCP(ln)
+	return nil
+}
+
+// Resolver returns a resolver that sends DNS queries through the interface's netstack to the
+// server. If the server isn't valid, queries are sent to the DNSServer of the exit that the
+// Config's linkLayer is attached to, which must have DNS enabled.
+func (v *Interface) Resolver(server netip.AddrPort) (*net.Resolver, error) {
+	if !server.IsValid() {
+		if v.mode != Entrance {
+			return nil, errors.New("only entrance interfaces can use the exit's dns server")
+		}
+		return netstack.NewResolver(v.Stack, v.nicId, DNSServer), nil
+	}
+	return netstack.NewResolver(v.Stack, 0, server), nil
+}
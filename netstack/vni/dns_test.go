@@ -0,0 +1,27 @@
+package vni
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetResolvesThroughExit(t *testing.T) {
+	en, ex := newTestPair(t, Config{DNS: true}, Config{DNS: true})
+	require.NotNil(t, en.Net().Resolver)
+	require.Nil(t, ex.Net().Resolver)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := en.Net().LookupHost(ctx, "localhost")
+	require.NoError(t, err)
+	require.Contains(t, addrs, "127.0.0.1")
+
+	// Hostnames that the exit can't resolve aren't found
+	_, err = en.Net().DialContext(ctx, "tcp", "does-not-exist.invalid:80")
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+	require.True(t, dnsErr.IsNotFound)
+}
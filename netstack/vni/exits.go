@@ -0,0 +1,285 @@
+package vni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"go.uber.org/zap"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"net/netip"
+	"sync"
+)
+
+// ExitConfig configures an additional exit of an Entrance interface, or an additional remote
+// peer of a Peer interface. Every exit is attached to its own NIC in the interface's netstack.
+type ExitConfig struct {
+	LinkLayer io.ReadWriter  // The linkLayer where packets to the exit are read/written
+	Routes    []netip.Prefix // The prefixes that are routed to the exit
+	Metric    int            // Lower metrics win when several exits have a route to the same prefix
+	Default   bool           // Whether destinations that no other route covers are routed to the exit
+
+	// The addresses of the NIC, which must be in the prefix of the exit's virtual network.
+	// They default to the interface's addresses, so remote peers on another virtual network
+	// need their own.
+	Address  netip.Prefix
+	Address6 netip.Prefix
+}
+
+// exitRoute routes a prefix to the NIC of one of an entrance's exits.
+type exitRoute struct {
+	prefix netip.Prefix
+	nicId  tcpip.NICID
+	metric int
+}
+
+// nic is a NIC in the netstack whose packets are read/written from/to a linkLayer.
+type nic struct {
+	id        tcpip.NICID
+	ep        *channel.Endpoint  // The internal netstack endpoint
+	epw       *netstack.Endpoint // The wrapper around the netstack endpoint that allows us to read/write packets over arbitrary transports
+	linkLayer io.ReadWriter
+	cancel    context.CancelFunc // Stops reading packets from the endpoint
+	drained   chan struct{}      // Closed once the packets queued for the linkLayer have been written
+	stopped   chan struct{}      // Closed once packets are no longer read from the linkLayer
+	closeOnce sync.Once
+}
+
+// close closes the linkLayer, if it can be closed, and the endpoint.
+func (n *nic) close() {
+	n.closeOnce.Do(func() {
+		if c, ok := n.linkLayer.(io.Closer); ok {
+			_ = c.Close()
+		}
+		n.ep.Close()
+	})
+}
+
+// wait waits until packets are no longer read from the linkLayer, so that none are injected into
+// the endpoint while the netstack removes it. Reads from linkLayers that can't be closed can't
+// be interrupted, so those aren't waited for.
+func (n *nic) wait() {
+	if _, ok := n.linkLayer.(io.Closer); ok {
+		<-n.stopped
+	}
+}
+
+// createNIC creates a NIC with the addresses, attached to the linkLayer. The caller must start
+// the NIC's linkLayerWorker.
+func (v *Interface) createNIC(id tcpip.NICID, linkLayer io.ReadWriter, address, address6 netip.Prefix) (*nic, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	ep := channel.New(128, v.mtu, "")
+	if tcpErr := v.Stack.CreateNIC(id, ep); tcpErr != nil {
+		return nil, errors.New(tcpErr.String())
+	}
+	v.Stack.AddProtocolAddress(id, tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.Address(address.Addr().AsSlice()),
+			PrefixLen: address.Bits(),
+		},
+	}, stack.AddressProperties{})
+	v.Stack.AddProtocolAddress(id, tcpip.ProtocolAddress{
+		Protocol: ipv6.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.Address(address6.Addr().AsSlice()),
+			PrefixLen: address6.Bits(),
+		},
+	}, stack.AddressProperties{})
+
+	ctx, cancel := context.WithCancel(v.ctx)
+	epw := netstack.WrapChannel(ep)
+	epw.Logger = v.logger.Named(v.mode.String())
+	epw.Context = ctx
+	n := &nic{
+		id:        id,
+		ep:        ep,
+		epw:       epw,
+		linkLayer: linkLayer,
+		cancel:    cancel,
+		drained:   make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	v.nics[id] = n
+	return n, nil
+}
+
+// AddExit attaches another exit to an Entrance interface, or another remote peer to a Peer
+// interface, and returns the ID of the exit's NIC. Packets are routed to the exit with the
+// longest prefix that covers their destination, and to the exit with the lowest metric among
+// those. A Peer interface also forwards the packets that the remote peer sends, and routes the
+// prefixes of the NIC's addresses back to it. If the exit's linkLayer fails, the exit is removed.
+func (v *Interface) AddExit(cfg ExitConfig) (tcpip.NICID, error) {
+	if v.mode == Exit {
+		return 0, errors.New("exits can only be added to entrance and peer interfaces")
+	}
+	if cfg.LinkLayer == nil {
+		return 0, errors.New("linkLayer cannot be nil")
+	}
+	for _, p := range cfg.Routes {
+		if !p.IsValid() {
+			return 0, fmt.Errorf("invalid route %s", p)
+		}
+	}
+
+	v.mu.Lock()
+	id := v.nextNicId
+	v.nextNicId++
+	if !cfg.Address.IsValid() {
+		cfg.Address = v.address
+	}
+	if !cfg.Address6.IsValid() {
+		cfg.Address6 = v.address6
+	}
+	v.mu.Unlock()
+
+	n, err := v.createNIC(id, cfg.LinkLayer, cfg.Address, cfg.Address6)
+	if err != nil {
+		return 0, err
+	}
+	v.mu.Lock()
+	if v.mode == Peer {
+		// Like the Config's linkLayer, the remote peer sends packets to destinations behind this
+		// peer and expects the replies through the same NIC
+		v.Stack.SetPromiscuousMode(id, true)
+		v.Stack.SetSpoofing(id, true)
+		for _, p := range []netip.Prefix{cfg.Address, cfg.Address6} {
+			gateway := v.gateway
+			if p.Addr().Is6() {
+				gateway = v.gateway6
+			}
+			v.routes = append(v.routes, tcpip.Route{
+				Destination: tcpip.AddressWithPrefix{
+					Address:   tcpip.Address(p.Masked().Addr().AsSlice()),
+					PrefixLen: p.Bits(),
+				}.Subnet(),
+				Gateway: gateway,
+				NIC:     id,
+			})
+		}
+	}
+	for _, p := range cfg.Routes {
+		v.exitRoutes = append(v.exitRoutes, exitRoute{prefix: p.Masked(), nicId: id, metric: cfg.Metric})
+	}
+	if cfg.Default {
+		v.defaultNic = id
+	}
+	v.updateRouteTable()
+	v.mu.Unlock()
+
+	v.logger.Debug("added exit", zap.Uint32("nic", uint32(id)), zap.Int("routes", len(cfg.Routes)))
+	go v.linkLayerWorker(n)
+	return id, nil
+}
+
+// RemoveExit removes an exit that was added with AddExit, along with its routes. If it was the
+// default exit of an entrance, the Config's linkLayer becomes the default exit again.
+func (v *Interface) RemoveExit(id tcpip.NICID) error {
+	if id == v.nicId {
+		return errors.New("the interface's own linkLayer can't be removed")
+	}
+	if !v.removeExit(id, nil) {
+		return fmt.Errorf("no exit with NIC %d", id)
+	}
+	return nil
+}
+
+// removeExit removes the exit's NIC and routes, and closes its linkLayer once the packets
+// queued for it have been written. The cause is logged if the exit failed.
+func (v *Interface) removeExit(id tcpip.NICID, cause error) bool {
+	v.mu.Lock()
+	n, ok := v.nics[id]
+	if !ok {
+		v.mu.Unlock()
+		return false
+	}
+	delete(v.nics, id)
+	routes := v.exitRoutes[:0]
+	for _, r := range v.exitRoutes {
+		if r.nicId != id {
+			routes = append(routes, r)
+		}
+	}
+	v.exitRoutes = routes
+	ownRoutes := v.routes[:0]
+	for _, r := range v.routes {
+		if r.NIC != id {
+			ownRoutes = append(ownRoutes, r)
+		}
+	}
+	v.routes = ownRoutes
+	if v.defaultNic == id && v.mode == Entrance {
+		v.defaultNic = v.nicId
+	} else if v.defaultNic == id {
+		v.defaultNic = 0
+	}
+	v.updateRouteTable()
+	v.mu.Unlock()
+
+	if cause != nil {
+		v.logger.Warn("removing exit", zap.Uint32("nic", uint32(id)), zap.Error(cause))
+	}
+	n.cancel()
+	go func() {
+		<-n.drained
+		n.close()
+		n.wait()
+		_ = v.Stack.RemoveNIC(id)
+	}()
+	return true
+}
+
+// SetExitRoutes replaces the prefixes routed to an exit. The ID of the Config's linkLayer NIC
+// (1) can be used to route prefixes to it as well, which is how peers route packets to the
+// routes exposed by the remote peer.
+func (v *Interface) SetExitRoutes(id tcpip.NICID, routes []netip.Prefix, metric int) error {
+	if v.mode == Exit {
+		return errors.New("exits can only be added to entrance and peer interfaces")
+	}
+	for _, p := range routes {
+		if !p.IsValid() {
+			return fmt.Errorf("invalid route %s", p)
+		}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.nics[id]; !ok {
+		return fmt.Errorf("no exit with NIC %d", id)
+	}
+	exitRoutes := v.exitRoutes[:0]
+	for _, r := range v.exitRoutes {
+		if r.nicId != id {
+			exitRoutes = append(exitRoutes, r)
+		}
+	}
+	for _, p := range routes {
+		exitRoutes = append(exitRoutes, exitRoute{prefix: p.Masked(), nicId: id, metric: metric})
+	}
+	v.exitRoutes = exitRoutes
+	v.updateRouteTable()
+	return nil
+}
+
+// SetDefaultExit routes destinations that no other route covers to the exit.
+func (v *Interface) SetDefaultExit(id tcpip.NICID) error {
+	if v.mode == Exit {
+		return errors.New("exits can only be added to entrance and peer interfaces")
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.nics[id]; !ok {
+		return fmt.Errorf("no exit with NIC %d", id)
+	}
+	v.defaultNic = id
+	v.updateRouteTable()
+	return nil
+}
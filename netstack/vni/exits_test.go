@@ -0,0 +1,243 @@
+package vni
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// routedNIC returns the NIC of the first route in the netstack's routing table that covers the
+// destination, which is the route that the netstack uses.
+func routedNIC(v *Interface, dst netip.Addr) tcpip.NICID {
+	for _, r := range v.Stack.GetRouteTable() {
+		if r.Destination.Contains(tcpip.Address(dst.AsSlice())) {
+			return r.NIC
+		}
+	}
+	return 0
+}
+
+// newTestExitLink returns a linkLayer for AddExit whose other end is closed with the test.
+func newTestExitLink(t *testing.T) net.Conn {
+	l1, l2 := net.Pipe()
+	t.Cleanup(func() { _ = l2.Close() })
+	return l1
+}
+
+func TestExitRouteTable(t *testing.T) {
+	type exit struct {
+		routes  []string
+		metric  int
+		dflt    bool
+		removed bool
+	}
+	for _, tc := range []struct {
+		name  string
+		exits []exit
+		dst   string
+		nic   int // The index of the exit that dst is routed to, or -1 for the Config's linkLayer
+	}{
+		{
+			name:  "default route of the entrance",
+			exits: []exit{{routes: []string{"10.1.0.0/16"}}},
+			dst:   "192.0.2.1",
+			nic:   -1,
+		},
+		{
+			name:  "exit route",
+			exits: []exit{{routes: []string{"10.1.0.0/16"}}},
+			dst:   "10.1.2.3",
+			nic:   0,
+		},
+		{
+			name: "longest prefix wins over metric",
+			exits: []exit{
+				{routes: []string{"10.0.0.0/8"}, metric: 0},
+				{routes: []string{"10.1.0.0/16"}, metric: 100},
+			},
+			dst: "10.1.2.3",
+			nic: 1,
+		},
+		{
+			name: "shorter prefix outside the longer one",
+			exits: []exit{
+				{routes: []string{"10.0.0.0/8"}, metric: 0},
+				{routes: []string{"10.1.0.0/16"}, metric: 100},
+			},
+			dst: "10.2.0.1",
+			nic: 0,
+		},
+		{
+			name: "lowest metric wins a tie",
+			exits: []exit{
+				{routes: []string{"10.1.0.0/16"}, metric: 20},
+				{routes: []string{"10.1.0.0/16"}, metric: 10},
+				{routes: []string{"10.1.0.0/16"}, metric: 30},
+			},
+			dst: "10.1.2.3",
+			nic: 1,
+		},
+		{
+			name: "ipv6",
+			exits: []exit{
+				{routes: []string{"fd00::/8"}, metric: 0},
+				{routes: []string{"fd00:1::/32"}, metric: 10},
+			},
+			dst: "fd00:1::1",
+			nic: 1,
+		},
+		{
+			name:  "default exit",
+			exits: []exit{{routes: []string{"10.1.0.0/16"}}, {dflt: true}},
+			dst:   "192.0.2.1",
+			nic:   1,
+		},
+		{
+			name:  "more specific route than the default exit",
+			exits: []exit{{routes: []string{"10.1.0.0/16"}}, {dflt: true}},
+			dst:   "10.1.2.3",
+			nic:   0,
+		},
+		{
+			name: "fallback after removing the best route",
+			exits: []exit{
+				{routes: []string{"10.1.0.0/16"}, metric: 20},
+				{routes: []string{"10.1.0.0/16"}, metric: 10, removed: true},
+			},
+			dst: "10.1.2.3",
+			nic: 0,
+		},
+		{
+			name:  "fallback after removing the default exit",
+			exits: []exit{{routes: []string{"10.1.0.0/16"}}, {dflt: true, removed: true}},
+			dst:   "192.0.2.1",
+			nic:   -1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			en, err := New(Config{Mode: Entrance, LinkLayer: newTestExitLink(t)})
+			require.NoError(t, err)
+			t.Cleanup(en.Stop)
+			ids := make([]tcpip.NICID, len(tc.exits))
+			for i, e := range tc.exits {
+				cfg := ExitConfig{LinkLayer: newTestExitLink(t), Metric: e.metric, Default: e.dflt}
+				for _, r := range e.routes {
+					cfg.Routes = append(cfg.Routes, netip.MustParsePrefix(r))
+				}
+				ids[i], err = en.AddExit(cfg)
+				require.NoError(t, err)
+			}
+			for i, e := range tc.exits {
+				if e.removed {
+					require.NoError(t, en.RemoveExit(ids[i]))
+				}
+			}
+			expected := en.nicId
+			if tc.nic >= 0 {
+				expected = ids[tc.nic]
+			}
+			require.Equal(t, expected, routedNIC(en, netip.MustParseAddr(tc.dst)))
+		})
+	}
+}
+
+func TestSetExitRoutes(t *testing.T) {
+	en, err := New(Config{Mode: Entrance, LinkLayer: newTestExitLink(t)})
+	require.NoError(t, err)
+	t.Cleanup(en.Stop)
+	a, err := en.AddExit(ExitConfig{LinkLayer: newTestExitLink(t), Routes: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}})
+	require.NoError(t, err)
+	dst := netip.MustParseAddr("10.1.2.3")
+	require.Equal(t, a, routedNIC(en, dst))
+
+	// Replacing an exit's routes removes its old ones
+	require.NoError(t, en.SetExitRoutes(a, []netip.Prefix{netip.MustParsePrefix("10.2.0.0/16")}, 0))
+	require.Equal(t, en.nicId, routedNIC(en, dst))
+	require.Equal(t, a, routedNIC(en, netip.MustParseAddr("10.2.0.1")))
+
+	// Routes can also be sent through the Config's linkLayer, and the default exit can change
+	require.NoError(t, en.SetExitRoutes(en.nicId, []netip.Prefix{netip.MustParsePrefix("10.2.3.0/24")}, 0))
+	require.Equal(t, en.nicId, routedNIC(en, netip.MustParseAddr("10.2.3.4")))
+	require.NoError(t, en.SetDefaultExit(a))
+	require.Equal(t, a, routedNIC(en, netip.MustParseAddr("192.0.2.1")))
+
+	require.Error(t, en.SetExitRoutes(99, nil, 0))
+	require.Error(t, en.SetDefaultExit(99))
+	require.Error(t, en.RemoveExit(99))
+	require.Error(t, en.RemoveExit(en.nicId))
+}
+
+func TestEntranceRoutesAcrossExits(t *testing.T) {
+	addr := hostAddr(t, false)
+	ln, err := net.Listen("tcp", netip.AddrPortFrom(addr, 0).String())
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// The entrance's default exit doesn't expose the host address, the added exit does
+	en, a := newTestPair(t, Config{}, Config{}, "10.0.0.0/8")
+	l1, l2 := net.Pipe()
+	b, err := New(Config{Mode: Exit, LinkLayer: l2})
+	require.NoError(t, err)
+	t.Cleanup(b.Stop)
+	hostRoute := netip.PrefixFrom(addr, 32)
+	require.NoError(t, b.ExposeRoutes([]string{hostRoute.String()}))
+	id, err := en.AddExit(ExitConfig{LinkLayer: l1, Routes: []netip.Prefix{hostRoute}})
+	require.NoError(t, err)
+
+	dial := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := en.Net().DialContext(ctx, "tcp", ln.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+	require.NoError(t, dial())
+
+	// Once the exit is removed, the default exit is used again, which refuses the connection
+	// until it exposes the address too
+	require.NoError(t, en.RemoveExit(id))
+	require.Error(t, dial())
+	require.NoError(t, a.ExposeRoutes([]string{hostRoute.String()}))
+	require.NoError(t, dial())
+}
+
+func TestPeerAddExit(t *testing.T) {
+	addr := hostAddr(t, false)
+	echo := udpEcho(t, addr)
+	route := netip.PrefixFrom(addr, 32)
+
+	// a is connected to b through its Config's linkLayer, and to c through an added NIC on
+	// another virtual network. a and c route the host to each other.
+	l1, l2 := net.Pipe()
+	a := newTestPeer(t, l1, "10.50.0.1/24", "fd50::1/64", route.String())
+	newTestPeer(t, l2, "10.50.0.2/24", "fd50::2/64")
+	l3, l4 := net.Pipe()
+	c := newTestPeer(t, l4, "10.51.0.2/24", "fd51::2/64", route.String())
+	_, err := a.AddExit(ExitConfig{
+		LinkLayer: l3,
+		Routes:    []netip.Prefix{route},
+		Address:   netip.MustParsePrefix("10.51.0.1/24"),
+		Address6:  netip.MustParsePrefix("fd51::1/64"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.SetExitRoutes(c.nicId, []netip.Prefix{route}, 0))
+
+	// The added NIC forwards c's flows, and replies to c are routed back through it
+	requirePeerEcho(t, a, echo)
+	requirePeerEcho(t, c, echo)
+}
@@ -0,0 +1,394 @@
+package vni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"github.com/clarkmcc/remotenetstack/utils"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mapping forwards a host address to an address on the other side of the tunnel.
+type Mapping struct {
+	Network string         // "tcp" or "udp"
+	Listen  string         // The host address to listen on, such as "localhost:15432"
+	Remote  netip.AddrPort // The address that connections are forwarded to through the tunnel
+}
+
+// ParseMapping parses a mapping such as "localhost:15432->10.1.2.3:5432". Mappings are TCP
+// unless the remote address is followed by "/udp", as in ":5353->10.1.2.3:53/udp".
+func ParseMapping(s string) (Mapping, error) {
+	listen, remote, ok := strings.Cut(s, "->")
+	if !ok {
+		return Mapping{}, fmt.Errorf("invalid mapping %q, expected listen->remote", s)
+	}
+	m := Mapping{Network: "tcp", Listen: strings.TrimSpace(listen)}
+	remote = strings.TrimSpace(remote)
+	if r, network, ok := strings.Cut(remote, "/"); ok {
+		remote, m.Network = r, network
+	}
+	var err error
+	if m.Remote, err = netip.ParseAddrPort(remote); err != nil {
+		return Mapping{}, fmt.Errorf("invalid remote address in mapping %q: %w", s, err)
+	}
+	m.Remote = netip.AddrPortFrom(m.Remote.Addr().Unmap(), m.Remote.Port())
+	return m, m.validate()
+}
+
+func (m Mapping) validate() error {
+	if m.Network != "tcp" && m.Network != "udp" {
+		return fmt.Errorf("invalid network %q in mapping %s", m.Network, m)
+	}
+	if _, _, err := net.SplitHostPort(m.Listen); err != nil {
+		return fmt.Errorf("invalid listen address in mapping %s: %w", m, err)
+	}
+	if !m.Remote.IsValid() {
+		return fmt.Errorf("invalid remote address in mapping %s", m)
+	}
+	return nil
+}
+
+// String returns the mapping in the format of ParseMapping.
+func (m Mapping) String() string {
+	if m.Network == "udp" {
+		return m.Listen + "->" + m.Remote.String() + "/udp"
+	}
+	return m.Listen + "->" + m.Remote.String()
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (m Mapping) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *Mapping) UnmarshalText(text []byte) error {
+	parsed, err := ParseMapping(string(text))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// MappingStats are the connection counts of one of a PortForwarder's mappings.
+type MappingStats struct {
+	Mapping Mapping
+	Addr    net.Addr // The host address that the mapping listens on
+	Active  int64    // The open connections, or the UDP sessions that haven't timed out
+	Total   uint64   // The connections or UDP sessions since the mapping started listening
+}
+
+// PortForwarder listens on host addresses and forwards connections through the tunnel.
+type PortForwarder struct {
+	logger    *zap.Logger
+	net       *netstack.Net
+	forwards  []*portForward
+	done      chan struct{}   // Closed once the forwarder stops listening
+	ctx       context.Context // Canceled once the forwarder stops listening, which aborts dials
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	wg        sync.WaitGroup // Tracks the listeners and the forwarded connections
+
+	mu     sync.Mutex
+	conns  map[io.Closer]struct{} // The open connections, on both sides of the tunnel
+	forced bool                   // Whether the connections were closed before they ended
+}
+
+// portForward is a mapping and the host socket that it listens on.
+type portForward struct {
+	mapping Mapping
+	ln      net.Listener   // Set for TCP mappings
+	pc      net.PacketConn // Set for UDP mappings
+	active  atomic.Int64
+	total   atomic.Uint64
+}
+
+// Forward listens on the host addresses of the mappings, like ssh -L, and forwards every
+// connection that it accepts, or every UDP client that sends to it, through the tunnel to the
+// mapping's remote address. UDP sessions end after a period without any packets. The forwarder
+// stops when it's closed or when the interface shuts down.
+func (v *Interface) Forward(mappings ...Mapping) (*PortForwarder, error) {
+	if v.mode == Exit {
+		return nil, errors.New("port forwarding is only supported by entrance and peer interfaces")
+	}
+	for _, m := range mappings {
+		if err := m.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if v.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &PortForwarder{
+		logger: v.logger.Named("port-forwarder"),
+		net:    v.Net(),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  map[io.Closer]struct{}{},
+	}
+	for _, m := range mappings {
+		fw := &portForward{mapping: m}
+		var err error
+		if m.Network == "tcp" {
+			fw.ln, err = net.Listen("tcp", m.Listen)
+		} else {
+			fw.pc, err = net.ListenPacket("udp", m.Listen)
+		}
+		if err != nil {
+			for _, fw := range f.forwards {
+				fw.close()
+			}
+			cancel()
+			return nil, err
+		}
+		f.forwards = append(f.forwards, fw)
+	}
+	for _, fw := range f.forwards {
+		f.wg.Add(1)
+		if fw.ln != nil {
+			go f.serveTCP(fw)
+		} else {
+			go f.serveUDP(fw)
+		}
+	}
+	go func() {
+		select {
+		case <-v.ctx.Done():
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_ = f.Close(ctx)
+		case <-f.done:
+		}
+	}()
+	return f, nil
+}
+
+// Stats returns the connection counts of the forwarder's mappings.
+func (f *PortForwarder) Stats() []MappingStats {
+	stats := make([]MappingStats, 0, len(f.forwards))
+	for _, fw := range f.forwards {
+		stats = append(stats, MappingStats{
+			Mapping: fw.mapping,
+			Addr:    fw.addr(),
+			Active:  fw.active.Load(),
+			Total:   fw.total.Load(),
+		})
+	}
+	return stats
+}
+
+// Close stops listening and waits for the forwarded TCP connections to end, or for the context
+// to be done, in which case the remaining connections are closed. UDP sessions end as soon as
+// the forwarder stops listening.
+func (f *PortForwarder) Close(ctx context.Context) error {
+	f.closeOnce.Do(func() {
+		close(f.done)
+		f.cancel()
+		for _, fw := range f.forwards {
+			fw.close()
+		}
+	})
+	ended := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+		return nil
+	case <-ctx.Done():
+		f.mu.Lock()
+		f.forced = true
+		for c := range f.conns {
+			_ = c.Close()
+		}
+		f.mu.Unlock()
+		<-ended
+		return ctx.Err()
+	}
+}
+
+// track adds the connection to the ones that are closed when the forwarder is closed, unless
+// they were already closed.
+func (f *PortForwarder) track(c io.Closer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.forced {
+		return false
+	}
+	f.conns[c] = struct{}{}
+	return true
+}
+
+func (f *PortForwarder) untrack(c io.Closer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, c)
+}
+
+// serveTCP accepts connections until the listener is closed.
+func (f *PortForwarder) serveTCP(fw *portForward) {
+	defer f.wg.Done()
+	logger := f.logger.With(zap.Stringer("mapping", fw.mapping))
+	logger.Debug("forwarding connections")
+	for {
+		conn, err := fw.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("accepting connection", zap.Error(err))
+			}
+			return
+		}
+		f.wg.Add(1)
+		go f.forwardConn(logger, fw, conn)
+	}
+}
+
+// forwardConn dials the mapping's remote address through the tunnel and joins it with the
+// connection.
+func (f *PortForwarder) forwardConn(logger *zap.Logger, fw *portForward, conn net.Conn) {
+	defer f.wg.Done()
+	defer conn.Close()
+	if !f.track(conn) {
+		return
+	}
+	defer f.untrack(conn)
+	fw.total.Inc()
+	fw.active.Inc()
+	defer fw.active.Dec()
+
+	target, err := f.net.DialContext(f.ctx, "tcp", fw.mapping.Remote.String())
+	if err != nil {
+		logger.Warn("dialing remote", zap.Stringer("client", conn.RemoteAddr()), zap.Error(err))
+		return
+	}
+	defer target.Close()
+	if !f.track(target) {
+		return
+	}
+	defer f.untrack(target)
+	logger.Debug("forwarding connection", zap.Stringer("client", conn.RemoteAddr()))
+	utils.Join(conn, target)
+}
+
+// udpSession is the socket on the netstack that relays the datagrams of one UDP client.
+type udpSession struct {
+	conn net.Conn
+	last time.Time // When the client last sent a datagram
+}
+
+// serveUDP relays the datagrams of each client through its own socket on the netstack until
+// the host socket is closed, which ends every session.
+func (f *PortForwarder) serveUDP(fw *portForward) {
+	defer f.wg.Done()
+	logger := f.logger.With(zap.Stringer("mapping", fw.mapping))
+	logger.Debug("forwarding datagrams")
+
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range sessions {
+			_ = s.conn.Close()
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := fw.pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("reading datagram", zap.Error(err))
+			}
+			return
+		}
+		// Sessions only end while holding mu, and not after the client sent a datagram
+		// within udpTimeout, so a session that's found here stays open for the write
+		mu.Lock()
+		s, ok := sessions[addr.String()]
+		if ok {
+			s.last = time.Now()
+		}
+		mu.Unlock()
+		if !ok {
+			conn, err := f.net.DialContext(f.ctx, "udp", fw.mapping.Remote.String())
+			if err != nil {
+				logger.Warn("dialing remote", zap.Stringer("client", addr), zap.Error(err))
+				continue
+			}
+			s = &udpSession{conn: conn, last: time.Now()}
+			mu.Lock()
+			sessions[addr.String()] = s
+			mu.Unlock()
+			fw.total.Inc()
+			fw.active.Inc()
+			f.wg.Add(1)
+			go func(addr net.Addr, s *udpSession) {
+				defer f.wg.Done()
+				defer fw.active.Dec()
+				f.relayUDP(fw, s.conn, addr, func(idle bool) bool {
+					mu.Lock()
+					defer mu.Unlock()
+					if idle && time.Since(s.last) < udpTimeout {
+						return false
+					}
+					delete(sessions, addr.String())
+					return true
+				})
+			}(addr, s)
+		}
+		if _, err = s.conn.Write(buf[:n]); err != nil {
+			logger.Debug("sending datagram", zap.Stringer("client", addr), zap.Error(err))
+		}
+	}
+}
+
+// relayUDP sends the datagrams from the remote address back to the client until the session
+// ends. When reading fails, end is called with whether the session was idle, and returns
+// whether the session ended, which idle sessions don't if the client sent a datagram since.
+func (f *PortForwarder) relayUDP(fw *portForward, conn net.Conn, addr net.Addr, end func(idle bool) bool) {
+	defer conn.Close()
+	buf := make([]byte, 65535)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(udpTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if end(errors.As(err, &netErr) && netErr.Timeout()) {
+				return
+			}
+			continue
+		}
+		if _, err = fw.pc.WriteTo(buf[:n], addr); err != nil {
+			end(false)
+			return
+		}
+	}
+}
+
+func (fw *portForward) addr() net.Addr {
+	if fw.ln != nil {
+		return fw.ln.Addr()
+	}
+	return fw.pc.LocalAddr()
+}
+
+func (fw *portForward) close() {
+	if fw.ln != nil {
+		_ = fw.ln.Close()
+	} else {
+		_ = fw.pc.Close()
+	}
+}
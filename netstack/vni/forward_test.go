@@ -0,0 +1,92 @@
+package vni
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseMapping(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		mapping Mapping
+		err     string
+	}{
+		{s: "localhost:15432->10.1.2.3:5432", mapping: Mapping{Network: "tcp", Listen: "localhost:15432", Remote: netip.MustParseAddrPort("10.1.2.3:5432")}},
+		{s: " :5353 -> 10.1.2.3:53/udp ", mapping: Mapping{Network: "udp", Listen: ":5353", Remote: netip.MustParseAddrPort("10.1.2.3:53")}},
+		{s: "[::1]:8080->[fd00::1]:80/tcp", mapping: Mapping{Network: "tcp", Listen: "[::1]:8080", Remote: netip.MustParseAddrPort("[fd00::1]:80")}},
+		{s: ":8080->[::ffff:10.1.2.3]:80", mapping: Mapping{Network: "tcp", Listen: ":8080", Remote: netip.MustParseAddrPort("10.1.2.3:80")}},
+		{s: ":8080", err: `invalid mapping ":8080", expected listen->remote`},
+		{s: ":8080->example.com:80", err: `invalid remote address in mapping ":8080->example.com:80"`},
+		{s: ":8080->10.1.2.3", err: `invalid remote address in mapping ":8080->10.1.2.3"`},
+		{s: ":8080->10.1.2.3:80/sctp", err: `invalid network "sctp" in mapping :8080->10.1.2.3:80`},
+		{s: "8080->10.1.2.3:80", err: "invalid listen address in mapping 8080->10.1.2.3:80"},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			m, err := ParseMapping(tc.s)
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.mapping, m)
+
+			// Mappings round trip through their text form
+			var parsed Mapping
+			require.NoError(t, parsed.UnmarshalText([]byte(m.String())))
+			require.Equal(t, m, parsed)
+		})
+	}
+}
+
+func TestForward(t *testing.T) {
+	addr := hostAddr(t, false)
+	ln, err := net.Listen("tcp", netip.AddrPortFrom(addr, 0).String())
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	echo := udpEcho(t, addr)
+	en, _ := newTestPair(t, Config{}, Config{}, netip.PrefixFrom(addr, 32).String())
+
+	f, err := en.Forward(
+		Mapping{Network: "tcp", Listen: "127.0.0.1:0", Remote: netip.MustParseAddrPort(ln.Addr().String())},
+		Mapping{Network: "udp", Listen: "127.0.0.1:0", Remote: netip.MustParseAddrPort(echo.String())})
+	require.NoError(t, err)
+	stats := f.Stats()
+
+	tcpConn, err := net.Dial("tcp", stats[0].Addr.String())
+	require.NoError(t, err)
+	defer tcpConn.Close()
+	requireEcho(t, tcpConn, []byte("ping"))
+	udpConn, err := net.Dial("udp", stats[1].Addr.String())
+	require.NoError(t, err)
+	defer udpConn.Close()
+	requireEcho(t, udpConn, []byte("ping"))
+	requireEcho(t, udpConn, []byte("pong"))
+
+	stats = f.Stats()
+	require.Equal(t, int64(1), stats[0].Active)
+	require.Equal(t, uint64(1), stats[1].Total)
+
+	// Closing the forwarder ends the connections that are still open
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, f.Close(ctx), context.DeadlineExceeded)
+	_, err = tcpConn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
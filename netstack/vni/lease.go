@@ -0,0 +1,437 @@
+package vni
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// LeaseServer is the address that exits serve address leases on. It's added to the NIC of
+// exits that lease addresses, and is reached by entrances through their default route.
+var LeaseServer = netip.MustParseAddrPort("169.254.0.1:6767")
+
+// DefaultLeaseTime is how long leases last when Config.LeaseTime isn't set. Entrances renew
+// their lease when half of it has elapsed.
+const DefaultLeaseTime = 10 * time.Minute
+
+// MinLeaseTime is the shortest lease time that exits grant and entrances accept, which keeps
+// entrances from flooding the exit with renewals.
+const MinLeaseTime = time.Second
+
+// leaseTimeout is how long entrances wait for the exit to answer a lease request.
+const leaseTimeout = 2 * time.Second
+
+type leaseOp string
+
+const (
+	leaseRequest leaseOp = "request" // Sent by entrances to get or renew a lease
+	leaseAck     leaseOp = "ack"     // Sent by exits with the leased addresses
+	leaseNak     leaseOp = "nak"     // Sent by exits when no addresses can be leased
+	leaseRelease leaseOp = "release" // Sent by entrances when they're closed
+)
+
+// leaseMessage is exchanged between entrances and exits over UDP, encoded as JSON. The
+// addresses in requests are the addresses that the entrance would like to keep, if any.
+type leaseMessage struct {
+	Op       leaseOp       `json:"op"`
+	ClientID string        `json:"client_id"`
+	Address  netip.Prefix  `json:"address"`
+	Address6 netip.Prefix  `json:"address6"`
+	Gateway  netip.Addr    `json:"gateway"`
+	Gateway6 netip.Addr    `json:"gateway6"`
+	Lifetime time.Duration `json:"lifetime"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// lease is an address lease that an exit granted to an entrance.
+type lease struct {
+	address  netip.Addr
+	address6 netip.Addr
+	expires  time.Time
+}
+
+// leaser holds the lease state of an Interface. Exits use leases and leaseTime, entrances
+// use clientID and leased.
+type leaser struct {
+	pool      *Pool
+	pool6     *Pool
+	leaseTime time.Duration
+	leases    map[string]*lease // Leases granted by an exit, keyed by client ID
+
+	clientID string
+	leased   chan struct{} // Closed once an entrance got its first lease
+}
+
+// newClientID returns a random ID that identifies an entrance to the exit.
+func newClientID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// temporaryAddress returns a random address in the pool without allocating it. Entrances that
+// get their addresses from the exit use it until they get a lease, and it's random so that
+// entrances in different processes are unlikely to use the same address.
+func temporaryAddress(_ netip.Prefix, pool *Pool) (netip.Prefix, func(), error) {
+	return netip.PrefixFrom(pool.random(), pool.Prefix().Bits()), func() {}, nil
+}
+
+// addServerAddress adds the address of one of the servers that exits run inside their stack to
+// the NIC. Servers can share an address, so addresses that were already added are kept.
+func (v *Interface) addServerAddress(addr netip.Addr) error {
+	tcpErr := v.Stack.AddProtocolAddress(v.nicId, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.Address(addr.AsSlice()).WithPrefix(),
+	}, stack.AddressProperties{})
+	if _, ok := tcpErr.(*tcpip.ErrDuplicateAddress); tcpErr != nil && !ok {
+		return fmt.Errorf("adding address %s: %s", addr, tcpErr)
+	}
+	return nil
+}
+
+// serveLeases answers lease requests from entrances until the interface shuts down, and
+// releases the addresses of expired leases.
+func (v *Interface) serveLeases() error {
+	if err := v.addServerAddress(LeaseServer.Addr()); err != nil {
+		return err
+	}
+	conn, err := gonet.DialUDP(v.Stack, &tcpip.FullAddress{
+		NIC:  v.nicId,
+		Addr: tcpip.Address(LeaseServer.Addr().AsSlice()),
+		Port: LeaseServer.Port(),
+	}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		return err
+	}
+	logger := v.logger.Named("lease-server")
+
+	go func() {
+		<-v.ctx.Done()
+		_ = conn.Close()
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		for id := range v.leases {
+			v.expireLease(id)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(v.leaseTime / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-v.ctx.Done():
+				return
+			}
+			now := time.Now()
+			v.mu.Lock()
+			for id, l := range v.leases {
+				if now.After(l.expires) {
+					logger.Debug("lease expired", zap.String("client_id", id))
+					v.expireLease(id)
+				}
+			}
+			v.mu.Unlock()
+		}
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req leaseMessage
+			if err = json.Unmarshal(buf[:n], &req); err != nil || req.ClientID == "" {
+				logger.Debug("ignoring invalid lease message", zap.Stringer("from", addr))
+				continue
+			}
+			res, ok := v.handleLease(req)
+			if !ok {
+				continue
+			}
+			b, err := json.Marshal(res)
+			if err != nil {
+				continue
+			}
+			if _, err = conn.WriteTo(b, addr); err != nil {
+				logger.Debug("writing lease response", zap.Error(err))
+			}
+		}
+	}()
+	return nil
+}
+
+// handleLease grants, renews or releases a lease, returning the response to send back to
+// the entrance, if any.
+func (v *Interface) handleLease(req leaseMessage) (leaseMessage, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	logger := v.logger.With(zap.String("client_id", req.ClientID))
+	if req.Op == leaseRelease {
+		logger.Debug("lease released")
+		v.expireLease(req.ClientID)
+		return leaseMessage{}, false
+	}
+	if req.Op != leaseRequest {
+		return leaseMessage{}, false
+	}
+
+	l, ok := v.leases[req.ClientID]
+	if !ok {
+		var err error
+		l = &lease{}
+		if l.address, err = leaseAddress(v.pool, req.Address); err == nil {
+			if l.address6, err = leaseAddress(v.pool6, req.Address6); err != nil {
+				v.pool.Release(l.address)
+			}
+		}
+		if err != nil {
+			logger.Warn("leasing addresses", zap.Error(err))
+			return leaseMessage{Op: leaseNak, ClientID: req.ClientID, Error: err.Error()}, true
+		}
+		logger.Info("leased addresses",
+			zap.String("address", l.address.String()),
+			zap.String("address6", l.address6.String()))
+		v.leases[req.ClientID] = l
+	}
+	l.expires = time.Now().Add(v.leaseTime)
+	return leaseMessage{
+		Op:       leaseAck,
+		ClientID: req.ClientID,
+		Address:  netip.PrefixFrom(l.address, v.pool.Prefix().Bits()),
+		Address6: netip.PrefixFrom(l.address6, v.pool6.Prefix().Bits()),
+		Gateway:  v.address.Addr(),
+		Gateway6: v.address6.Addr(),
+		Lifetime: v.leaseTime,
+	}, true
+}
+
+// leaseAddress reserves the requested address if it's available, which lets entrances keep
+// their addresses when the exit restarts, or allocates a new one. The caller must hold mu.
+func leaseAddress(pool *Pool, requested netip.Prefix) (netip.Addr, error) {
+	if requested.IsValid() && pool.Reserve(requested.Addr()) == nil {
+		return requested.Addr(), nil
+	}
+	return pool.Allocate()
+}
+
+// expireLease removes the lease and releases its addresses. The caller must hold mu.
+func (v *Interface) expireLease(id string) {
+	l, ok := v.leases[id]
+	if !ok {
+		return
+	}
+	delete(v.leases, id)
+	v.pool.Release(l.address)
+	v.pool6.Release(l.address6)
+}
+
+// requestLeases gets a lease from the exit and keeps renewing it until the interface shuts
+// down. The NIC is reconfigured every time the exit leases different addresses.
+func (v *Interface) requestLeases() {
+	logger := v.logger.Named("lease-client")
+	backoff := time.Second
+	for {
+		res, err := v.requestLease()
+		if err != nil {
+			if v.ctx.Err() != nil {
+				return
+			}
+			logger.Warn("requesting lease", zap.Error(err), zap.Duration("backoff", backoff))
+			select {
+			case <-time.After(backoff):
+			case <-v.ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+			continue
+		}
+		backoff = time.Second
+		if err = v.applyLease(res); err != nil {
+			// The NIC keeps its current addresses, the lease is applied again when it's renewed
+			logger.Warn("applying lease", zap.Error(err))
+		}
+		select {
+		case <-time.After(res.Lifetime / 2):
+		case <-v.ctx.Done():
+			return
+		}
+	}
+}
+
+// requestLease sends a lease request to the exit and waits for the response.
+func (v *Interface) requestLease() (leaseMessage, error) {
+	v.mu.Lock()
+	req := leaseMessage{Op: leaseRequest, ClientID: v.clientID}
+	select {
+	case <-v.leased:
+		req.Address, req.Address6 = v.address, v.address6
+	default:
+	}
+	v.mu.Unlock()
+
+	conn, err := v.dialLeaseServer()
+	if err != nil {
+		return leaseMessage{}, err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-v.ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return leaseMessage{}, err
+	}
+	if _, err = conn.Write(b); err != nil {
+		return leaseMessage{}, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(leaseTimeout))
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return leaseMessage{}, err
+		}
+		var res leaseMessage
+		if err = json.Unmarshal(buf[:n], &res); err != nil || res.ClientID != v.clientID {
+			continue
+		}
+		switch {
+		case res.Op == leaseNak:
+			return leaseMessage{}, fmt.Errorf("lease refused by exit: %s", res.Error)
+		case res.Op != leaseAck:
+			continue
+		case !res.Address.Addr().Is4() || !res.Address6.Addr().Is6() || res.Lifetime < MinLeaseTime:
+			return leaseMessage{}, errors.New("invalid lease")
+		}
+		return res, nil
+	}
+}
+
+// releaseLease tells the exit that the lease is no longer needed. The message is only queued,
+// and is written to the linkLayer while the interface drains.
+func (v *Interface) releaseLease() {
+	conn, err := v.dialLeaseServer()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	b, err := json.Marshal(leaseMessage{Op: leaseRelease, ClientID: v.clientID})
+	if err != nil {
+		return
+	}
+	_, _ = conn.Write(b)
+}
+
+// dialLeaseServer returns a UDP connection to the exit's lease server. Connections are bound
+// to the NIC's current address, so a new one is needed after the addresses change.
+func (v *Interface) dialLeaseServer() (*gonet.UDPConn, error) {
+	return gonet.DialUDP(v.Stack, nil, &tcpip.FullAddress{
+		NIC:  v.nicId,
+		Addr: tcpip.Address(LeaseServer.Addr().AsSlice()),
+		Port: LeaseServer.Port(),
+	}, ipv4.ProtocolNumber)
+}
+
+// applyLease replaces the NIC's addresses and the gateways of its routes with the leased ones.
+// If the leased addresses can't be added, the NIC keeps its current addresses.
+func (v *Interface) applyLease(res leaseMessage) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if res.Address != v.address || res.Address6 != v.address6 {
+		if err := v.replaceAddresses(res.Address, res.Address6); err != nil {
+			return err
+		}
+		v.logger.Info("leased addresses",
+			zap.String("address", res.Address.String()),
+			zap.String("address6", res.Address6.String()))
+		v.gateway = tcpip.Address(res.Gateway.AsSlice())
+		v.gateway6 = tcpip.Address(res.Gateway6.AsSlice())
+		for i, r := range v.routes {
+			if len(r.Destination.ID()) == net.IPv4len {
+				v.routes[i].Gateway = v.gateway
+			} else {
+				v.routes[i].Gateway = v.gateway6
+			}
+		}
+		v.updateRouteTable()
+	}
+	select {
+	case <-v.leased:
+	default:
+		close(v.leased)
+	}
+	return nil
+}
+
+// replaceAddresses replaces the NIC's addresses. The new addresses are added before the old
+// ones are removed, so the NIC keeps its old addresses if they can't be added. The caller must
+// hold mu.
+func (v *Interface) replaceAddresses(address, address6 netip.Prefix) error {
+	var added []netip.Prefix
+	for _, r := range []struct {
+		proto     tcpip.NetworkProtocolNumber
+		old, addr netip.Prefix
+	}{
+		{ipv4.ProtocolNumber, v.address, address},
+		{ipv6.ProtocolNumber, v.address6, address6},
+	} {
+		if r.old == r.addr {
+			continue
+		}
+		if tcpErr := v.Stack.AddProtocolAddress(v.nicId, tcpip.ProtocolAddress{
+			Protocol: r.proto,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   tcpip.Address(r.addr.Addr().AsSlice()),
+				PrefixLen: r.addr.Bits(),
+			},
+		}, stack.AddressProperties{}); tcpErr != nil {
+			for _, a := range added {
+				_ = v.Stack.RemoveAddress(v.nicId, tcpip.Address(a.Addr().AsSlice()))
+			}
+			return fmt.Errorf("adding address %s: %s", r.addr, tcpErr)
+		}
+		added = append(added, r.addr)
+		_ = v.Stack.RemoveAddress(v.nicId, tcpip.Address(r.old.Addr().AsSlice()))
+	}
+	v.address, v.address6 = address, address6
+	return nil
+}
+
+// WaitLease waits until the exit leased addresses to the interface. It returns immediately
+// for interfaces that don't get their addresses from the exit.
+func (v *Interface) WaitLease(ctx context.Context) error {
+	if v.leased == nil {
+		return nil
+	}
+	select {
+	case <-v.leased:
+		return nil
+	case <-v.done:
+		return v.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,92 @@
+package vni
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newLeasePair connects an entrance to an exit that leases addresses from its own pools.
+func newLeasePair(t *testing.T) (*Interface, *Interface) {
+	pool := MustNewPool(netip.MustParsePrefix("100.100.0.0/24"))
+	pool6 := MustNewPool(netip.MustParsePrefix("fd7f:1::/120"))
+	return newTestPair(t,
+		Config{Leases: true, Pool: MustNewPool(pool.Prefix()), Pool6: MustNewPool(pool6.Prefix())},
+		Config{Leases: true, LeaseTime: MinLeaseTime, Pool: pool, Pool6: pool6})
+}
+
+// hasLease returns whether the exit leased addresses to the client.
+func hasLease(ex *Interface, id string) bool {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	_, ok := ex.leases[id]
+	return ok
+}
+
+func TestLeaseRenew(t *testing.T) {
+	en, ex := newLeasePair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, en.WaitLease(ctx))
+	addresses := en.Addresses()
+	require.True(t, ex.pool.Prefix().Contains(addresses[0].Addr()))
+	require.True(t, ex.pool6.Prefix().Contains(addresses[1].Addr()))
+	require.True(t, hasLease(ex, en.clientID))
+
+	// The entrance renews its lease before it expires and keeps its addresses
+	time.Sleep(2 * MinLeaseTime)
+	require.True(t, hasLease(ex, en.clientID))
+	require.Equal(t, addresses, en.Addresses())
+
+	// The exit can reach the entrance at its leased address
+	ln, err := en.Net().Listen("tcp", ":80")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := ex.Net().DialContext(ctx, "tcp", netip.AddrPortFrom(addresses[0].Addr(), 80).String())
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	// Closing the entrance releases its lease
+	require.NoError(t, en.Close(ctx))
+	require.Eventually(t, func() bool {
+		return !hasLease(ex, en.clientID)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLeaseExpire(t *testing.T) {
+	_, ex := newLeasePair(t)
+	res, ok := ex.handleLease(leaseMessage{Op: leaseRequest, ClientID: "client"})
+	require.True(t, ok)
+	require.Equal(t, leaseAck, res.Op)
+	require.Equal(t, MinLeaseTime, res.Lifetime)
+
+	// Leases that aren't renewed expire, and their addresses are returned to the pools
+	require.Eventually(t, func() bool {
+		return !hasLease(ex, "client")
+	}, 5*MinLeaseTime, 10*time.Millisecond)
+	require.NoError(t, ex.pool.Reserve(res.Address.Addr()))
+	require.NoError(t, ex.pool6.Reserve(res.Address6.Addr()))
+}
+
+func TestLeaseTime(t *testing.T) {
+	for _, d := range []time.Duration{-time.Second, time.Nanosecond, MinLeaseTime - 1} {
+		l1, _ := net.Pipe()
+		_, err := New(Config{Mode: Exit, LinkLayer: l1, Leases: true, LeaseTime: d})
+		require.Error(t, err, d)
+	}
+}
+
+func TestLeaseAndDNSShareAddress(t *testing.T) {
+	l1, _ := net.Pipe()
+	ex, err := New(Config{Mode: Exit, LinkLayer: l1, Leases: true, DNS: true})
+	require.NoError(t, err)
+	ex.Stop()
+}
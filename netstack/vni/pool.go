@@ -0,0 +1,141 @@
+package vni
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// DefaultPool is the pool that IPv4 NIC addresses are allocated from when neither an address
+// nor a pool is configured. It covers the CGNAT range, which is unlikely to clash with the
+// addresses of the networks that are exposed by exits.
+var DefaultPool = MustNewPool(netip.MustParsePrefix("100.64.0.0/10"))
+
+// DefaultPool6 is the IPv6 counterpart of DefaultPool, covering a unique local range.
+var DefaultPool6 = MustNewPool(netip.MustParsePrefix("fd7f::/64"))
+
+// ErrPoolExhausted is returned when every address in a Pool has been allocated.
+var ErrPoolExhausted = errors.New("address pool exhausted")
+
+// Pool allocates unique addresses from a prefix. Pools are safe for concurrent use, so a
+// single pool can be shared by every interface in the process. Pools start allocating from a
+// random address, so that interfaces in different processes, whose pools don't know about
+// each other, are unlikely to get the same address.
+type Pool struct {
+	prefix netip.Prefix
+	mu     sync.Mutex
+	next   netip.Addr              // Where the next allocation starts looking for a free address
+	used   map[netip.Addr]struct{} // Addresses that are currently allocated
+}
+
+// NewPool creates a pool that allocates addresses from the prefix. The first address of the
+// prefix, and the last one for IPv4 prefixes, are never allocated.
+func NewPool(prefix netip.Prefix) (*Pool, error) {
+	if !prefix.IsValid() {
+		return nil, errors.New("invalid pool prefix")
+	}
+	prefix = prefix.Masked()
+	if prefix.Bits() >= prefix.Addr().BitLen()-1 {
+		return nil, fmt.Errorf("pool prefix %s is too small", prefix)
+	}
+	p := &Pool{
+		prefix: prefix,
+		used:   map[netip.Addr]struct{}{},
+	}
+	p.next = p.random()
+	return p, nil
+}
+
+// MustNewPool is like NewPool but panics if the prefix is invalid.
+func MustNewPool(prefix netip.Prefix) *Pool {
+	p, err := NewPool(prefix)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Prefix returns the prefix that the pool allocates addresses from.
+func (p *Pool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Allocate returns an address that isn't allocated to anyone else until it's released.
+func (p *Pool) Allocate() (netip.Addr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := p.next
+	for addr := start; ; {
+		if p.usable(addr) {
+			if _, ok := p.used[addr]; !ok {
+				p.used[addr] = struct{}{}
+				p.next = p.wrap(addr.Next())
+				return addr, nil
+			}
+		}
+		if addr = p.wrap(addr.Next()); addr == start {
+			return netip.Addr{}, ErrPoolExhausted
+		}
+	}
+}
+
+// Reserve allocates a specific address, failing if it's already allocated or outside the pool.
+func (p *Pool) Reserve(addr netip.Addr) error {
+	if !p.prefix.Contains(addr) || !p.usable(addr) {
+		return fmt.Errorf("address %s is not in pool %s", addr, p.prefix)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.used[addr]; ok {
+		return fmt.Errorf("address %s is already in use", addr)
+	}
+	p.used[addr] = struct{}{}
+	return nil
+}
+
+// Release returns the address to the pool so that it can be allocated again.
+func (p *Pool) Release(addr netip.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, addr)
+}
+
+// random returns a random usable address in the pool, whether it's allocated or not.
+func (p *Pool) random() netip.Addr {
+	b := p.prefix.Addr().AsSlice()
+	r := make([]byte, len(b))
+	for {
+		_, _ = rand.Read(r)
+		for i := range b {
+			bits := p.prefix.Bits() - i*8
+			switch {
+			case bits <= 0:
+				b[i] = r[i]
+			case bits < 8:
+				b[i] = b[i]&^(0xff>>bits) | r[i]&(0xff>>bits)
+			}
+		}
+		addr, _ := netip.AddrFromSlice(b)
+		if p.usable(addr) {
+			return addr
+		}
+	}
+}
+
+// usable returns whether the address can be allocated at all.
+func (p *Pool) usable(addr netip.Addr) bool {
+	if addr == p.prefix.Addr() {
+		return false
+	}
+	return !addr.Is4() || p.prefix.Contains(addr.Next())
+}
+
+// wrap returns the first address of the pool if addr went past the end of the pool.
+func (p *Pool) wrap(addr netip.Addr) netip.Addr {
+	if !addr.IsValid() || !p.prefix.Contains(addr) {
+		return p.prefix.Addr()
+	}
+	return addr
+}
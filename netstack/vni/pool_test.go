@@ -0,0 +1,79 @@
+package vni
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+)
+
+func TestPoolAllocatesUniqueAddresses(t *testing.T) {
+	for _, prefix := range []string{"192.0.2.0/29", "fd00::/125"} {
+		t.Run(prefix, func(t *testing.T) {
+			p, err := NewPool(netip.MustParsePrefix(prefix))
+			require.NoError(t, err)
+
+			// Every usable address is allocated once, skipping the first address of the
+			// prefix and the IPv4 broadcast address
+			usable := 7
+			if p.Prefix().Addr().Is4() {
+				usable = 6
+			}
+			seen := map[netip.Addr]bool{}
+			for i := 0; i < usable; i++ {
+				addr, err := p.Allocate()
+				require.NoError(t, err)
+				require.True(t, p.Prefix().Contains(addr))
+				require.NotEqual(t, p.Prefix().Addr(), addr)
+				require.False(t, seen[addr], "%s allocated twice", addr)
+				seen[addr] = true
+			}
+			_, err = p.Allocate()
+			require.ErrorIs(t, err, ErrPoolExhausted)
+
+			// Released addresses can be allocated again
+			for addr := range seen {
+				p.Release(addr)
+				allocated, err := p.Allocate()
+				require.NoError(t, err)
+				require.Equal(t, addr, allocated)
+				break
+			}
+		})
+	}
+}
+
+func TestPoolReserve(t *testing.T) {
+	p := MustNewPool(netip.MustParsePrefix("192.0.2.0/24"))
+	addr := netip.MustParseAddr("192.0.2.10")
+	require.NoError(t, p.Reserve(addr))
+	require.EqualError(t, p.Reserve(addr), "address 192.0.2.10 is already in use")
+	require.EqualError(t, p.Reserve(netip.MustParseAddr("192.0.2.0")), "address 192.0.2.0 is not in pool 192.0.2.0/24")
+	require.EqualError(t, p.Reserve(netip.MustParseAddr("192.0.2.255")), "address 192.0.2.255 is not in pool 192.0.2.0/24")
+	require.EqualError(t, p.Reserve(netip.MustParseAddr("198.51.100.1")), "address 198.51.100.1 is not in pool 192.0.2.0/24")
+
+	// Reserved addresses are never allocated
+	for i := 0; i < 253; i++ {
+		allocated, err := p.Allocate()
+		require.NoError(t, err)
+		require.NotEqual(t, addr, allocated)
+	}
+	p.Release(addr)
+	allocated, err := p.Allocate()
+	require.NoError(t, err)
+	require.Equal(t, addr, allocated)
+}
+
+func TestPoolStartsAtRandomAddress(t *testing.T) {
+	// Pools in different processes don't know about each other, so they shouldn't all hand
+	// out the same first address
+	a, err := MustNewPool(DefaultPool.Prefix()).Allocate()
+	require.NoError(t, err)
+	b, err := MustNewPool(DefaultPool.Prefix()).Allocate()
+	require.NoError(t, err)
+	require.NotEqual(t, a, b)
+
+	_, err = NewPool(netip.MustParsePrefix("192.0.2.0/31"))
+	require.Error(t, err)
+	_, err = NewPool(netip.Prefix{})
+	require.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package vni
+
+import (
+	"errors"
+	"fmt"
+	"github.com/clarkmcc/remotenetstack/utils"
+	"go.uber.org/zap"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// Listen listens for TCP connections on the port of the interface's addresses, both IPv4 and
+// IPv6. It's usually called on an Entrance interface to serve connections that its exit
+// forwards from the exit's network with ReverseForward.
+func (v *Interface) Listen(port uint16) (net.Listener, error) {
+	if v.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	// An IPv6 listener without an address accepts IPv4 connections too
+	ln, err := gonet.ListenTCP(v.Stack, tcpip.FullAddress{Port: port}, ipv6.ProtocolNumber)
+	if err != nil {
+		return nil, fmt.Errorf("listening on port %d: %w", port, err)
+	}
+	return ln, nil
+}
+
+// ReverseForwarder accepts connections on a host address and forwards them through the tunnel.
+type ReverseForwarder struct {
+	logger    *zap.Logger
+	ln        net.Listener
+	target    netip.AddrPort
+	iface     *Interface
+	done      chan struct{} // Closed once the forwarder is closed
+	closeOnce sync.Once
+}
+
+// ReverseForward listens on a real host address, like ssh -R, and forwards every connection that
+// it accepts through the tunnel to the target, which is usually an address of an entrance that
+// listens on the port with Listen. The forwarder stops when it's closed or when the interface
+// shuts down.
+func (v *Interface) ReverseForward(listenAddr string, target netip.AddrPort) (*ReverseForwarder, error) {
+	if v.mode == Entrance {
+		return nil, errors.New("reverse forwarding is only supported by exit and peer interfaces")
+	}
+	if !target.IsValid() {
+		return nil, fmt.Errorf("invalid target %s", target)
+	}
+	if v.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReverseForwarder{
+		logger: v.logger.Named("reverse-forwarder").With(
+			zap.Stringer("listen", ln.Addr()),
+			zap.Stringer("target", target)),
+		ln:     ln,
+		target: target,
+		iface:  v,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-v.ctx.Done():
+			_ = r.Close()
+		case <-r.done:
+		}
+	}()
+	go r.serve()
+	return r, nil
+}
+
+// Addr returns the host address that the forwarder listens on.
+func (r *ReverseForwarder) Addr() net.Addr {
+	return r.ln.Addr()
+}
+
+// Close stops accepting connections. Connections that are already forwarded stay open.
+func (r *ReverseForwarder) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		err = r.ln.Close()
+	})
+	return err
+}
+
+// serve accepts connections until the listener is closed.
+func (r *ReverseForwarder) serve() {
+	r.logger.Debug("forwarding reverse connections")
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				r.logger.Warn("accepting connection", zap.Error(err))
+			}
+			return
+		}
+		go r.forward(conn)
+	}
+}
+
+// forward dials the target through the interface's netstack and joins it with the connection.
+func (r *ReverseForwarder) forward(conn net.Conn) {
+	defer conn.Close()
+	proto := ipv4.ProtocolNumber
+	if r.target.Addr().Is6() && !r.target.Addr().Is4In6() {
+		proto = ipv6.ProtocolNumber
+	}
+	target, err := gonet.DialContextTCP(r.iface.ctx, r.iface.Stack, tcpip.FullAddress{
+		Addr: tcpip.Address(r.target.Addr().Unmap().AsSlice()),
+		Port: r.target.Port(),
+	}, proto)
+	if err != nil {
+		r.logger.Warn("dialing target", zap.Stringer("remote", conn.RemoteAddr()), zap.Error(err))
+		return
+	}
+	defer target.Close()
+	r.logger.Debug("forwarding connection", zap.Stringer("remote", conn.RemoteAddr()))
+	utils.Join(conn, target)
+}
@@ -0,0 +1,65 @@
+package vni
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestReverseForward(t *testing.T) {
+	en, ex := newTestPair(t, Config{}, Config{})
+	ln, err := en.Listen(8080)
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// Connections to the exit's host address reach the entrance's listener over IPv4 and IPv6
+	for _, address := range en.Addresses() {
+		t.Run(address.Addr().String(), func(t *testing.T) {
+			r, err := ex.ReverseForward("127.0.0.1:0", netip.AddrPortFrom(address.Addr(), 8080))
+			require.NoError(t, err)
+			defer r.Close()
+			conn, err := net.Dial("tcp", r.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			requireEcho(t, conn, []byte("ping"))
+
+			// Closing the forwarder stops accepting connections, but the open ones keep working
+			require.NoError(t, r.Close())
+			require.NoError(t, r.Close())
+			_, err = net.Dial("tcp", r.Addr().String())
+			require.Error(t, err)
+			requireEcho(t, conn, []byte("pong"))
+		})
+	}
+
+	// Only exits and peers reverse forward, and not once they're stopped
+	_, err = en.ReverseForward("127.0.0.1:0", netip.AddrPortFrom(en.Addresses()[0].Addr(), 8080))
+	require.Error(t, err)
+	r, err := ex.ReverseForward("127.0.0.1:0", netip.AddrPortFrom(en.Addresses()[0].Addr(), 8080))
+	require.NoError(t, err)
+	ex.Stop()
+	_, err = ex.ReverseForward("127.0.0.1:0", netip.AddrPortFrom(en.Addresses()[0].Addr(), 8080))
+	require.ErrorIs(t, err, ErrClosed)
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", r.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -1,13 +1,13 @@
 package vni
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/clarkmcc/remotenetstack/netstack"
 	"github.com/clarkmcc/remotenetstack/utils"
 	"go.uber.org/zap"
 	"gvisor.dev/gvisor/pkg/tcpip"
-	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
@@ -16,22 +16,32 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"io"
 	"net/netip"
+	"sort"
+	"sync"
+	"time"
 )
 
-// defaultNicAddress is the address of the NIC in the virtual network interface. It's assigned arbitrarily
-// because it doesn't actually matter (right?) since we're not interfacing with any other networking systems
-var defaultNicAddress = tcpip.Address(netip.MustParseAddr("100.127.255.255").AsSlice())
-var defaultGatewayAddress = tcpip.Address(netip.MustParseAddr("100.127.255.255").AsSlice())
+// udpTimeout is how long UDP flows forwarded by Exit interfaces are kept open without any activity.
+const udpTimeout = 30 * time.Second
+
+// echoTimeout is how long Exit interfaces wait for the replies to the echo requests they forward.
+const echoTimeout = 10 * time.Second
+
+// ErrClosed is returned by Err once the Interface has been closed using Close.
+var ErrClosed = errors.New("interface closed")
 
 // Mode determines how the Interface operates. In Entrance
 // mode, the routes determine whether packets are forwarded to the Exit interface. In Exit mode,
-// the routes determine what packets are allowed to be forwarded. We always route from
-// entrance -> exit, not the other way around.
+// the routes determine what packets are allowed to be forwarded. Entrances and exits always
+// route from entrance -> exit, not the other way around. In Peer mode, the interface does both:
+// it forwards packets to the routes that it exposes, like an exit, and routes packets to the
+// remote peer's routes through the linkLayer, like an entrance.
 type Mode uint
 
 const (
 	Entrance Mode = iota
 	Exit
+	Peer
 )
 
 func (m Mode) String() string {
@@ -40,6 +50,8 @@ func (m Mode) String() string {
 		return "entrance"
 	case Exit:
 		return "exit"
+	case Peer:
+		return "peer"
 	default:
 		return "unknown"
 	}
@@ -47,15 +59,33 @@ func (m Mode) String() string {
 
 // Interface acts as a network interface that can be accessed remotely
 type Interface struct {
-	logger    *zap.Logger
-	Stack     *stack.Stack       // Userspace networking Stack
-	ep        *channel.Endpoint  // The internal netstack endpoint
-	epw       *netstack.Endpoint // The wrapper around the netstack endpoint that allows us to read/write packets over arbitrary transports
-	routes    []tcpip.Route      // Routes that are exposed via this network interface
-	mode      Mode               // Determines how this interface operates
-	nicId     tcpip.NICID        // The ID of the network interface in the netstack
-	linkLayer io.ReadWriter
-	stopChan  chan struct{}
+	logger     *zap.Logger
+	Stack      *stack.Stack         // Userspace networking Stack
+	nics       map[tcpip.NICID]*nic // The NICs that are attached to a linkLayer
+	routes     []tcpip.Route        // Routes that the interface installs for itself
+	exposed    []netip.Prefix       // Routes that are exposed via this network interface
+	exitRoutes []exitRoute          // Routes to the exits of an entrance interface
+	defaultNic tcpip.NICID          // The NIC of the default exit of an entrance interface
+	acl        *ACL                 // Decides which flows are forwarded by exits and peers
+	address    netip.Prefix         // The IPv4 address of the NIC and the prefix of the virtual network
+	address6   netip.Prefix         // The IPv6 address of the NIC and the prefix of the virtual network
+	gateway    tcpip.Address        // The gateway of IPv4 routes
+	gateway6   tcpip.Address        // The gateway of IPv6 routes
+	mode       Mode                 // Determines how this interface operates
+	dns        bool                 // Whether DNS is served by exits and peers, or used by entrances
+	nicId      tcpip.NICID          // The ID of the network interface attached to the Config's linkLayer
+	nextNicId  tcpip.NICID          // The ID of the next NIC added with AddExit
+	mtu        uint32
+	icmp       *netstack.ICMPForwarder // Forwards the echo requests of exits and peers
+	mu         sync.Mutex              // Guards the NICs, the routes, the addresses, the gateways and the leases
+	leaser
+
+	ctx       context.Context // Canceled when the interface starts shutting down
+	cancel    context.CancelFunc
+	done      chan struct{} // Closed once the interface has shut down
+	err       error         // Why the interface shut down
+	closeOnce sync.Once
+	release   []func() // Return the NIC's addresses to their pools
 }
 
 type Config struct {
@@ -63,6 +93,31 @@ type Config struct {
 	Mode      Mode          // The mode that this network interface should operate under
 	LinkLayer io.ReadWriter // The linkLayer where packets are read/written
 	MTU       uint32        // Maximum transmission unit
+
+	// The addresses of the NIC, along with the prefix of the virtual network that the NIC is
+	// part of. Exit interfaces route the whole prefix back through the linkLayer, so every
+	// interface that talks to an exit should have an address in the same prefix. Addresses
+	// are allocated from the pools when they aren't set, and addresses that are set are
+	// reserved in the pools if the pools cover them.
+	Address  netip.Prefix
+	Address6 netip.Prefix
+	Gateway  netip.Addr // The gateway of IPv4 routes through the NIC, defaults to Address
+	Gateway6 netip.Addr // The gateway of IPv6 routes through the NIC, defaults to Address6
+	Pool     *Pool      // The pool of IPv4 addresses, defaults to DefaultPool
+	Pool6    *Pool      // The pool of IPv6 addresses, defaults to DefaultPool6
+
+	// Leases lets exits lease addresses from their pools to the entrances that connect to
+	// them, and lets entrances get their addresses from the exit. Entrances ignore Address
+	// and Address6, and use random addresses from their pools until they get a lease.
+	Leases    bool
+	LeaseTime time.Duration // How long leases granted by an exit last, defaults to DefaultLeaseTime and must be at least MinLeaseTime
+
+	ACL *ACL // Decides which flows exits and peers forward, every flow to the exposed routes is forwarded when nil
+
+	// DNS lets exits and peers answer DNS queries sent to the DNSServer using their host's
+	// resolver, so that entrances can resolve names on the exit's side of the tunnel. On
+	// entrances, it makes the Net resolve names with the DNS server of their exit.
+	DNS bool
 }
 
 func New(config Config) (*Interface, error) {
@@ -75,10 +130,60 @@ func New(config Config) (*Interface, error) {
 	if config.Logger == nil {
 		config.Logger = zap.NewNop()
 	}
-	logger := config.Logger.Named("vni").With(zap.String("mode", config.Mode.String()))
+	if config.Pool == nil {
+		config.Pool = DefaultPool
+	}
+	if config.Pool6 == nil {
+		config.Pool6 = DefaultPool6
+	}
+	if config.LeaseTime == 0 {
+		config.LeaseTime = DefaultLeaseTime
+	}
+	if config.LeaseTime < MinLeaseTime {
+		return nil, fmt.Errorf("lease time %s is shorter than %s", config.LeaseTime, MinLeaseTime)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.ACL != nil {
+		if err := config.ACL.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Leases && config.Mode == Peer {
+		return nil, errors.New("leases aren't supported by peer interfaces")
+	}
+	var release []func()
+	releaseAll := func() {
+		for _, fn := range release {
+			fn()
+		}
+	}
+	assign := assignAddress
+	if config.Leases && config.Mode == Entrance {
+		assign = temporaryAddress
+	}
+	address, fn, err := assign(config.Address, config.Pool)
+	if err != nil {
+		return nil, err
+	}
+	release = append(release, fn)
+	address6, fn, err := assign(config.Address6, config.Pool6)
+	if err != nil {
+		releaseAll()
+		return nil, err
+	}
+	release = append(release, fn)
+	if !config.Gateway.IsValid() {
+		config.Gateway = address.Addr()
+	}
+	if !config.Gateway6.IsValid() {
+		config.Gateway6 = address6.Addr()
+	}
+	logger := config.Logger.Named("vni").With(
+		zap.String("mode", config.Mode.String()),
+		zap.String("address", address.Addr().String()))
 
-	nicId := tcpip.NICID(1)
-	ep := channel.New(128, config.MTU, "")
 	s := stack.New(stack.Options{
 		NetworkProtocols: []stack.NetworkProtocolFactory{
 			ipv4.NewProtocol,
@@ -92,120 +197,537 @@ func New(config Config) (*Interface, error) {
 		},
 	})
 
-	// Create a network interface in the netstack
-	tcpErr := s.CreateNIC(nicId, ep)
-	if tcpErr != nil {
-		return nil, errors.New(tcpErr.String())
-	}
-	s.AddProtocolAddress(nicId, tcpip.ProtocolAddress{
-		Protocol: ipv4.ProtocolNumber,
-		AddressWithPrefix: tcpip.AddressWithPrefix{
-			Address:   defaultNicAddress,
-			PrefixLen: 32,
-		},
-	}, stack.AddressProperties{})
-
-	epw := netstack.WrapChannel(ep)
-	epw.Logger = logger.Named(config.Mode.String())
+	ctx, cancel := context.WithCancel(context.Background())
 	iface := &Interface{
 		Stack:     s,
-		nicId:     nicId,
-		epw:       epw,
-		ep:        ep,
+		nics:      map[tcpip.NICID]*nic{},
+		nicId:     1,
+		nextNicId: 2,
+		mtu:       config.MTU,
 		mode:      config.Mode,
+		dns:       config.DNS,
 		logger:    logger,
-		linkLayer: config.LinkLayer,
-		stopChan:  make(chan struct{}),
+		address:   address,
+		address6:  address6,
+		gateway:   tcpip.Address(config.Gateway.AsSlice()),
+		gateway6:  tcpip.Address(config.Gateway6.AsSlice()),
+		release:   release,
+		acl:       config.ACL,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		leaser: leaser{
+			pool:      config.Pool,
+			pool6:     config.Pool6,
+			leaseTime: config.LeaseTime,
+			leases:    map[string]*lease{},
+		},
 	}
 
+	// Create a network interface in the netstack
+	n, err := iface.createNIC(iface.nicId, config.LinkLayer, address, address6)
+	if err != nil {
+		cancel()
+		releaseAll()
+		return nil, err
+	}
+	nicId := n.id
+
 	switch config.Mode {
 	case Entrance:
 		// For entrance interfaces, we want to accept packets for all routes
 		// and route them through this network interface.
-		iface.addRoute(tcpip.Route{
-			Destination: tcpip.AddressWithPrefix{
-				Address:   tcpip.Address(netip.MustParseAddr("0.0.0.0").AsSlice()),
-				PrefixLen: 0,
-			}.Subnet(),
-			Gateway: defaultGatewayAddress,
-			NIC:     nicId,
-		})
-	case Exit:
-		// Setup protocol forwarders on the exit interface
-		s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcp.NewForwarder(s, 0, 5, (&netstack.TCPForwarder{
+		iface.mu.Lock()
+		iface.defaultNic = nicId
+		iface.updateRouteTable()
+		iface.mu.Unlock()
+	case Exit, Peer:
+		// Setup protocol forwarders on the exit interface, which only forward flows to the
+		// exposed routes that the ACL allows. Echo requests are taken from the linkLayer
+		// before they reach the netstack, which would answer them itself.
+		s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcp.NewForwarder(s, 0, netstack.MaxInFlight, (&netstack.TCPForwarder{
 			Logger: config.Logger.Named("tcp-forwarder"),
+			Stack:  s,
+			Allow:  iface.allow,
 		}).Handle).HandlePacket)
 		s.SetTransportProtocolHandler(udp.ProtocolNumber, udp.NewForwarder(s, (&netstack.UDPForwarder{
-			Logger: config.Logger.Named("udp-forwarder"),
+			Logger:  config.Logger.Named("udp-forwarder"),
+			Stack:   s,
+			Timeout: udpTimeout,
+			MTU:     int(config.MTU),
+			Allow:   iface.allow,
 		}).Handle).HandlePacket)
+		iface.icmp = &netstack.ICMPForwarder{
+			Logger:  config.Logger.Named("icmp-forwarder"),
+			Stack:   s,
+			Timeout: echoTimeout,
+			Allow:   iface.allow,
+		}
 
-		// Add the route back to the gateway
+		// Add the routes back to the interfaces on the virtual network
+		iface.addRoute(tcpip.Route{
+			Destination: tcpip.AddressWithPrefix{
+				Address:   tcpip.Address(address.Masked().Addr().AsSlice()),
+				PrefixLen: address.Bits(),
+			}.Subnet(),
+			Gateway: iface.gateway,
+			NIC:     nicId,
+		})
 		iface.addRoute(tcpip.Route{
 			Destination: tcpip.AddressWithPrefix{
-				Address:   defaultNicAddress,
-				PrefixLen: 32,
+				Address:   tcpip.Address(address6.Masked().Addr().AsSlice()),
+				PrefixLen: address6.Bits(),
 			}.Subnet(),
-			Gateway: defaultGatewayAddress,
+			Gateway: iface.gateway6,
 			NIC:     nicId,
 		})
 
 		s.SetPromiscuousMode(nicId, true)
 		s.SetSpoofing(nicId, true)
+
+		if config.Leases && config.Mode == Exit {
+			if err = iface.serveLeases(); err != nil {
+				cancel()
+				s.Close()
+				releaseAll()
+				return nil, fmt.Errorf("serving leases: %w", err)
+			}
+		}
+		if config.DNS {
+			if err = iface.serveDNS(); err != nil {
+				cancel()
+				s.Close()
+				releaseAll()
+				return nil, fmt.Errorf("serving dns: %w", err)
+			}
+		}
 	}
 
-	go iface.linkLayerWorker()
+	if config.Leases && config.Mode == Entrance {
+		iface.clientID = newClientID()
+		iface.leased = make(chan struct{})
+	}
+	go iface.linkLayerWorker(n)
+	if iface.leased != nil {
+		go iface.requestLeases()
+	}
 	return iface, nil
 }
 
-// Stop stops the Interface and prevents it from forwarding any more packets to/from the linkLayer
+// validate checks that the addresses in the config don't conflict with each other.
+func (c Config) validate() error {
+	if c.Address.IsValid() && !c.Address.Addr().Is4() {
+		return fmt.Errorf("address %s is not an IPv4 address", c.Address)
+	}
+	if c.Address6.IsValid() && (!c.Address6.Addr().Is6() || c.Address6.Addr().Is4In6()) {
+		return fmt.Errorf("address %s is not an IPv6 address", c.Address6)
+	}
+	if c.Gateway.IsValid() && !c.Gateway.Is4() {
+		return fmt.Errorf("gateway %s is not an IPv4 address", c.Gateway)
+	}
+	if c.Gateway6.IsValid() && (!c.Gateway6.Is6() || c.Gateway6.Is4In6()) {
+		return fmt.Errorf("gateway %s is not an IPv6 address", c.Gateway6)
+	}
+	if c.Address.IsValid() && c.Gateway.IsValid() && !c.Address.Contains(c.Gateway) {
+		return fmt.Errorf("gateway %s is outside of %s", c.Gateway, c.Address.Masked())
+	}
+	if c.Address6.IsValid() && c.Gateway6.IsValid() && !c.Address6.Contains(c.Gateway6) {
+		return fmt.Errorf("gateway %s is outside of %s", c.Gateway6, c.Address6.Masked())
+	}
+	if !c.Address.IsValid() && c.Gateway.IsValid() && !c.Pool.Prefix().Contains(c.Gateway) {
+		return fmt.Errorf("gateway %s is outside of %s", c.Gateway, c.Pool.Prefix())
+	}
+	if !c.Address6.IsValid() && c.Gateway6.IsValid() && !c.Pool6.Prefix().Contains(c.Gateway6) {
+		return fmt.Errorf("gateway %s is outside of %s", c.Gateway6, c.Pool6.Prefix())
+	}
+	return nil
+}
+
+// assignAddress returns the configured address, reserving it if the pool covers it, or
+// allocates an address from the pool if no address is configured. The returned function
+// releases the address.
+func assignAddress(addr netip.Prefix, pool *Pool) (netip.Prefix, func(), error) {
+	if !addr.IsValid() {
+		a, err := pool.Allocate()
+		if err != nil {
+			return addr, nil, err
+		}
+		return netip.PrefixFrom(a, pool.Prefix().Bits()), func() { pool.Release(a) }, nil
+	}
+	if !pool.Prefix().Contains(addr.Addr()) {
+		return addr, func() {}, nil
+	}
+	if err := pool.Reserve(addr.Addr()); err != nil {
+		return addr, nil, err
+	}
+	return addr, func() { pool.Release(addr.Addr()) }, nil
+}
+
+// Addresses returns the IPv4 and IPv6 addresses of the NIC, along with the prefix of the virtual
+// network that the NIC is part of.
+func (v *Interface) Addresses() []netip.Prefix {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return []netip.Prefix{v.address, v.address6}
+}
+
+// Close shuts the Interface down. Packets that the stack already queued for the linkLayers
+// are written to them before the linkLayers (if they implement io.Closer), the endpoints and
+// the stack are closed. Close waits until the interface has shut down or ctx is done, in which
+// case the linkLayers are closed without waiting for the remaining packets to be written.
+// Calling Close more than once is safe.
+func (v *Interface) Close(ctx context.Context) error {
+	v.shutdown(ErrClosed)
+	select {
+	case <-v.done:
+		return nil
+	case <-ctx.Done():
+		v.mu.Lock()
+		for _, n := range v.nics {
+			n.close()
+		}
+		v.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Stop stops the Interface without waiting for it to shut down.
+//
+// Deprecated: use Close instead.
 func (v *Interface) Stop() {
-	close(v.stopChan)
+	v.shutdown(ErrClosed)
 }
 
-// linkLayerWorker reads/writes packets to/from the linkLayer and reads/writes them to the netstack.
-func (v *Interface) linkLayerWorker() {
-	for {
-		select {
-		case _, ok := <-v.stopChan:
-			if !ok {
+// Done returns a channel that's closed once the Interface has shut down, either because it
+// was closed or because reading from or writing to the linkLayer failed.
+func (v *Interface) Done() <-chan struct{} {
+	return v.done
+}
+
+// Err returns nil while the Interface is running. Once Done is closed, Err returns ErrClosed
+// if the Interface was closed, or the linkLayer's error if the linkLayer failed.
+func (v *Interface) Err() error {
+	select {
+	case <-v.done:
+		return v.err
+	default:
+		return nil
+	}
+}
+
+// shutdown starts shutting the Interface down in the background. Only the first call has
+// any effect, and err is recorded as the reason why the interface shut down.
+func (v *Interface) shutdown(err error) {
+	v.closeOnce.Do(func() {
+		if err != ErrClosed {
+			v.logger.Warn("shutting down", zap.Error(err))
+		}
+		v.err = err
+		if v.leased != nil {
+			v.releaseLease()
+		}
+		v.cancel()
+		go func() {
+			v.mu.Lock()
+			nics := make([]*nic, 0, len(v.nics))
+			for _, n := range v.nics {
+				nics = append(nics, n)
+			}
+			v.mu.Unlock()
+			for _, n := range nics {
+				<-n.drained
+				n.close()
+				n.wait()
+			}
+			v.Stack.Close()
+			v.Stack.Wait()
+			for _, fn := range v.release {
+				fn()
+			}
+			close(v.done)
+		}()
+	})
+}
+
+// linkLayerWorker reads/writes packets to/from the NIC's linkLayer and reads/writes them to the
+// netstack until the NIC is removed, the interface shuts down or the linkLayer fails.
+func (v *Interface) linkLayerWorker(n *nic) {
+	fail := func(err error) {
+		if n.id == v.nicId {
+			v.shutdown(err)
+		} else {
+			v.removeExit(n.id, err)
+		}
+	}
+	go func() {
+		defer close(n.stopped)
+		buf := utils.GetBuf(16 * 1024)
+		defer utils.PutBuf(buf)
+		for {
+			nr, err := n.linkLayer.Read(buf)
+			if err != nil {
+				fail(fmt.Errorf("reading from link layer: %w", err))
 				return
 			}
-		default:
-			utils.Join(v.epw, v.linkLayer)
+			if v.icmp != nil && v.icmp.HandlePacket(n.id, buf[:nr]) {
+				continue
+			}
+			_, _ = n.epw.Write(buf[:nr])
+		}
+	}()
+
+	defer close(n.drained)
+	buf := utils.GetBuf(16 * 1024)
+	defer utils.PutBuf(buf)
+	for {
+		// Reads from the endpoint fail once the NIC is removed or the interface starts
+		// shutting down
+		nr, err := n.epw.Read(buf)
+		if err != nil {
+			break
+		}
+		if _, err = n.linkLayer.Write(buf[:nr]); errors.Is(err, netstack.ErrQueueFull) {
+			v.logger.Debug("dropping packet", zap.Error(err))
+		} else if err != nil {
+			fail(fmt.Errorf("writing to link layer: %w", err))
+			return
+		}
+	}
+
+	// Drain the packets that are still queued in the endpoint
+	for {
+		pkt := n.ep.Read()
+		if pkt == nil {
+			return
+		}
+		b := pkt.ToBuffer()
+		nr := copy(buf, b.Flatten())
+		pkt.DecRef()
+		if _, err := n.linkLayer.Write(buf[:nr]); err != nil {
+			return
 		}
 	}
 }
 
 // addRoute adds a new route to the network interface and updates the netstack's routing table
 func (v *Interface) addRoute(route tcpip.Route) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
 	v.routes = append(v.routes, route)
 	v.logger.Debug("adding route", zap.String("route", route.String()))
-	v.Stack.SetRouteTable(v.routes)
+	v.updateRouteTable()
+}
+
+// updateRouteTable replaces the netstack's routing table with the interface's own routes, the
+// exposed routes, the routes to the exits and the default routes. The netstack uses the first
+// route that matches a destination, so routes are sorted from the longest to the shortest
+// prefix, and then by metric. The caller must hold mu.
+func (v *Interface) updateRouteTable() {
+	type entry struct {
+		route  tcpip.Route
+		metric int
+	}
+	var entries []entry
+	add := func(p netip.Prefix, nicId tcpip.NICID, metric int) {
+		gateway := v.gateway
+		if p.Addr().Is6() {
+			gateway = v.gateway6
+		}
+		entries = append(entries, entry{route: tcpip.Route{
+			Destination: tcpip.AddressWithPrefix{
+				Address:   tcpip.Address(p.Addr().AsSlice()),
+				PrefixLen: p.Bits(),
+			}.Subnet(),
+			Gateway: gateway,
+			NIC:     nicId,
+		}, metric: metric})
+	}
+	for _, r := range v.routes {
+		entries = append(entries, entry{route: r})
+	}
+	if v.mode == Exit {
+		// Peers don't route their exposed routes through the linkLayer, they're reached
+		// through the forwarders
+		for _, p := range v.exposed {
+			add(p, v.nicId, 0)
+		}
+	}
+	for _, r := range v.exitRoutes {
+		add(r.prefix, r.nicId, r.metric)
+	}
+	if v.defaultNic != 0 {
+		add(netip.PrefixFrom(netip.IPv4Unspecified(), 0), v.defaultNic, 0)
+		add(netip.PrefixFrom(netip.IPv6Unspecified(), 0), v.defaultNic, 0)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		pi, pj := entries[i].route.Destination.Prefix(), entries[j].route.Destination.Prefix()
+		if pi != pj {
+			return pi > pj
+		}
+		return entries[i].metric < entries[j].metric
+	})
+
+	table := make([]tcpip.Route, 0, len(entries))
+	for _, e := range entries {
+		table = append(table, e.route)
+	}
+	v.Stack.SetRouteTable(table)
 }
 
 // ExposeRoutes allows the caller to expose routes to the remote network interface. This should
 // only be called on Exit interfaces, entrance interfaces will automatically expose all routes.
+// Routes that are already exposed are ignored.
 func (v *Interface) ExposeRoutes(routes []string) error {
+	rp, err := v.parseRoutes(routes)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, r := range rp {
+		if !containsPrefix(v.exposed, r) {
+			v.logger.Debug("exposing route", zap.String("route", r.String()))
+			v.exposed = append(v.exposed, r)
+		}
+	}
+	v.updateRouteTable()
+	return nil
+}
+
+// WithdrawRoutes stops exposing the routes to the remote network interface. Routes that aren't
+// exposed are ignored.
+func (v *Interface) WithdrawRoutes(routes []string) error {
+	rp, err := v.parseRoutes(routes)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	exposed := v.exposed[:0]
+	for _, r := range v.exposed {
+		if containsPrefix(rp, r) {
+			v.logger.Debug("withdrawing route", zap.String("route", r.String()))
+			continue
+		}
+		exposed = append(exposed, r)
+	}
+	v.exposed = exposed
+	v.updateRouteTable()
+	return nil
+}
+
+// ReplaceRoutes atomically replaces all the exposed routes with the provided routes. None of
+// the routes are replaced if any of them are invalid.
+func (v *Interface) ReplaceRoutes(routes []string) error {
+	rp, err := v.parseRoutes(routes)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.exposed = v.exposed[:0]
+	for _, r := range rp {
+		if !containsPrefix(v.exposed, r) {
+			v.exposed = append(v.exposed, r)
+		}
+	}
+	v.logger.Debug("replacing routes", zap.Int("routes", len(v.exposed)))
+	v.updateRouteTable()
+	return nil
+}
+
+// ExposedRoutes returns the routes that are exposed with ExposeRoutes.
+func (v *Interface) ExposedRoutes() []netip.Prefix {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]netip.Prefix(nil), v.exposed...)
+}
+
+// Routes returns the netstack's current routing table. Besides the exposed routes, this
+// includes the routes that the interface installs for itself, such as the default route of
+// Entrance interfaces and the route back to the gateway of Exit interfaces.
+func (v *Interface) Routes() []netip.Prefix {
+	table := v.Stack.GetRouteTable()
+	routes := make([]netip.Prefix, 0, len(table))
+	for _, r := range table {
+		addr, ok := netip.AddrFromSlice([]byte(r.Destination.ID()))
+		if !ok {
+			continue
+		}
+		routes = append(routes, netip.PrefixFrom(addr, r.Destination.Prefix()))
+	}
+	return routes
+}
+
+// allow decides whether the forwarders forward the flow. Flows are only forwarded to the
+// exposed routes, and only if the ACL allows them.
+func (v *Interface) allow(f netstack.Flow) bool {
+	v.mu.Lock()
+	exposed := containsAddr(v.exposed, f.Destination.Addr())
+	acl := v.acl
+	v.mu.Unlock()
+	if !exposed {
+		v.logger.Debug("denied flow to route that isn't exposed", zap.Stringer("flow", f))
+		return false
+	}
+	if acl == nil {
+		return true
+	}
+	action, rule := acl.Evaluate(f)
+	if action == Deny {
+		v.logger.Info("denied flow", zap.Stringer("flow", f), zap.Int("rule", rule))
+		return false
+	}
+	return true
+}
+
+// SetACL replaces the ACL that decides which flows exits and peers forward. A nil ACL allows
+// every flow to the exposed routes.
+func (v *Interface) SetACL(acl *ACL) error {
+	if acl != nil {
+		if err := acl.Validate(); err != nil {
+			return err
+		}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.acl = acl
+	return nil
+}
+
+// parseRoutes parses the routes that the caller wants to expose or withdraw.
+func (v *Interface) parseRoutes(routes []string) ([]netip.Prefix, error) {
 	if v.mode == Entrance {
-		return fmt.Errorf("cannot expose routes on entrance interface")
+		return nil, fmt.Errorf("cannot expose or withdraw routes on entrance interface")
 	}
 	var rp []netip.Prefix
 	for _, r := range routes {
 		p, err := netip.ParsePrefix(r)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		rp = append(rp, p)
+		rp = append(rp, p.Masked())
 	}
-	for _, r := range rp {
-		v.addRoute(tcpip.Route{
-			Destination: tcpip.AddressWithPrefix{
-				Address:   tcpip.Address(r.Masked().Addr().AsSlice()),
-				PrefixLen: r.Bits(),
-			}.Subnet(),
-			Gateway: defaultGatewayAddress,
-			NIC:     v.nicId,
-		})
+	return rp, nil
+}
+
+// containsPrefix returns whether the prefix is in the list of prefixes.
+func containsPrefix(prefixes []netip.Prefix, p netip.Prefix) bool {
+	for _, q := range prefixes {
+		if q == p {
+			return true
+		}
 	}
-	return nil
+	return false
+}
+
+// Net returns a Net that dials and listens on the interface's netstack, using its routing table.
+// Entrances with DNS enabled look hostnames up with the DNS server of their exit, other
+// interfaces look them up with the host's resolver unless the Net's Resolver is replaced.
+func (v *Interface) Net() *netstack.Net {
+	n := netstack.NewNet(v.Stack)
+	if v.dns && v.mode == Entrance {
+		n.Resolver, _ = v.Resolver(netip.AddrPort{})
+	}
+	return n
 }
@@ -0,0 +1,386 @@
+package vni
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	xicmp "golang.org/x/net/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newTestPair connects an entrance to an exit that exposes the routes.
+func newTestPair(t *testing.T, entrance, exit Config, routes ...string) (*Interface, *Interface) {
+	l1, l2 := net.Pipe()
+	entrance.Mode = Entrance
+	entrance.LinkLayer = l1
+	exit.Mode = Exit
+	exit.LinkLayer = l2
+	ex, err := New(exit)
+	require.NoError(t, err)
+	require.NoError(t, ex.ExposeRoutes(routes))
+	en, err := New(entrance)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		en.Stop()
+		ex.Stop()
+	})
+	return en, ex
+}
+
+// hostAddr returns a global unicast address of the host, since the netstack drops packets to
+// loopback addresses.
+func hostAddr(t *testing.T, ipv6 bool) netip.Addr {
+	addrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(n.IP)
+		addr = addr.Unmap()
+		if ok && addr.Is6() == ipv6 && addr.IsGlobalUnicast() {
+			return addr
+		}
+	}
+	t.Skip("host has no global unicast address")
+	return netip.Addr{}
+}
+
+// udpEcho listens for UDP datagrams on the host and sends them back.
+func udpEcho(t *testing.T, addr netip.Addr) net.Addr {
+	conn, err := net.ListenPacket("udp", netip.AddrPortFrom(addr, 0).String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr()
+}
+
+// requireEcho sends the payload through the entrance and waits for it to come back.
+func requireEcho(t *testing.T, conn net.Conn, payload []byte) {
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err := conn.Write(payload)
+	require.NoError(t, err)
+	buf := make([]byte, len(payload)+1)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(payload, buf[:n]))
+}
+
+func TestExitForwardsUDP(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		t.Run(map[bool]string{false: "ipv4", true: "ipv6"}[ipv6], func(t *testing.T) {
+			addr := hostAddr(t, ipv6)
+			en, _ := newTestPair(t, Config{}, Config{}, netip.PrefixFrom(addr, addr.BitLen()).String())
+			echo := udpEcho(t, addr)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := en.Net().DialContext(ctx, "udp", echo.String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// Replies are written back to the exit's netstack, and datagrams as large as the
+			// MTU allows aren't truncated on the way back
+			requireEcho(t, conn, []byte("ping"))
+			requireEcho(t, conn, bytes.Repeat([]byte{1}, 1400))
+		})
+	}
+}
+
+func TestExitForwardsOnlyExposedRoutes(t *testing.T) {
+	addr := hostAddr(t, false)
+	ln, err := net.Listen("tcp", netip.AddrPortFrom(addr, 0).String())
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	echo := udpEcho(t, addr)
+	en, ex := newTestPair(t, Config{}, Config{}, "10.0.0.0/8")
+
+	dial := func(network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return en.Net().DialContext(ctx, network, address)
+	}
+
+	// Destinations that the exit doesn't expose are refused, even though the exit can reach them
+	_, err = dial("tcp", ln.Addr().String())
+	require.Error(t, err)
+	conn, err := dial("udp", echo.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, err = conn.Read(make([]byte, 4))
+	require.Error(t, err)
+
+	// And forwarded once they're exposed
+	require.NoError(t, ex.ExposeRoutes([]string{netip.PrefixFrom(addr, 32).String()}))
+	tcpConn, err := dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	_ = tcpConn.Close()
+	requireEcho(t, conn, []byte("ping"))
+}
+
+func TestInterfaceLinkLayerFailure(t *testing.T) {
+	l1, l2 := net.Pipe()
+	en, err := New(Config{Mode: Entrance, LinkLayer: l1})
+	require.NoError(t, err)
+	t.Cleanup(en.Stop)
+	require.NoError(t, en.Err())
+
+	// Closing the other end of the pipe fails the entrance's reads
+	require.NoError(t, l2.Close())
+	select {
+	case <-en.Done():
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "interface didn't shut down after its link layer failed")
+	}
+	require.ErrorIs(t, en.Err(), io.EOF)
+	require.NotErrorIs(t, en.Err(), ErrClosed)
+}
+
+func TestInterfaceClose(t *testing.T) {
+	l1, l2 := net.Pipe()
+	en, err := New(Config{Mode: Entrance, LinkLayer: l1})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, en.Close(ctx))
+	select {
+	case <-en.Done():
+	default:
+		require.Fail(t, "Done isn't closed after Close returned")
+	}
+	require.ErrorIs(t, en.Err(), ErrClosed)
+
+	// The link layer is closed too, and closing the interface again is a no-op
+	_, err = l2.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, en.Close(ctx))
+	en.Stop()
+	require.ErrorIs(t, en.Err(), ErrClosed)
+	_, err = en.Forward(Mapping{Network: "tcp", Listen: "127.0.0.1:0", Remote: netip.MustParseAddrPort("10.0.0.1:80")})
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestExitForwardsTCP(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		t.Run(map[bool]string{false: "ipv4", true: "ipv6"}[ipv6], func(t *testing.T) {
+			addr := hostAddr(t, ipv6)
+			en, _ := newTestPair(t, Config{}, Config{}, netip.PrefixFrom(addr, addr.BitLen()).String())
+			ln, err := net.Listen("tcp", netip.AddrPortFrom(addr, 0).String())
+			require.NoError(t, err)
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := en.Net().DialContext(ctx, "tcp", ln.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			requireEcho(t, conn, []byte("ping"))
+		})
+	}
+}
+
+// TestIPv6Tunnel doesn't depend on the host's addresses, unlike the forwarder tests, which are
+// skipped on hosts without IPv6.
+func TestIPv6Tunnel(t *testing.T) {
+	en, ex := newTestPair(t, Config{}, Config{}, "fd00:1234::/32")
+	address6 := en.Addresses()[1]
+	require.True(t, address6.Addr().Is6())
+	require.Contains(t, en.Routes(), netip.MustParsePrefix("::/0"))
+	require.Contains(t, ex.Routes(), netip.MustParsePrefix("fd00:1234::/32"))
+
+	// A TCP connection and UDP datagrams from the entrance reach the exit's own IPv6 address
+	exitAddr := tcpip.FullAddress{Addr: tcpip.Address(ex.Addresses()[1].Addr().AsSlice()), Port: 8080}
+	ln, err := gonet.ListenTCP(ex.Stack, exitAddr, ipv6.ProtocolNumber)
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := gonet.DialContextTCP(ctx, en.Stack, exitAddr, ipv6.ProtocolNumber)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, address6.Addr().String(), conn.LocalAddr().(*net.TCPAddr).IP.String())
+	requireEcho(t, conn, []byte("ping"))
+
+	pc, err := gonet.DialUDP(ex.Stack, &exitAddr, nil, ipv6.ProtocolNumber)
+	require.NoError(t, err)
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	uc, err := gonet.DialUDP(en.Stack, nil, &exitAddr, ipv6.ProtocolNumber)
+	require.NoError(t, err)
+	defer uc.Close()
+	requireEcho(t, uc, []byte("ping"))
+}
+
+// newTestPeer creates a Peer interface with the addresses, which exposes the routes.
+func newTestPeer(t *testing.T, linkLayer io.ReadWriter, address, address6 string, routes ...string) *Interface {
+	p, err := New(Config{
+		Mode:      Peer,
+		LinkLayer: linkLayer,
+		Address:   netip.MustParsePrefix(address),
+		Address6:  netip.MustParsePrefix(address6),
+	})
+	require.NoError(t, err)
+	t.Cleanup(p.Stop)
+	require.NoError(t, p.ExposeRoutes(routes))
+	return p
+}
+
+// requirePeerEcho dials the UDP echo server through the peer.
+func requirePeerEcho(t *testing.T, p *Interface, echo net.Addr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := p.Net().DialContext(ctx, "udp", echo.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	requireEcho(t, conn, []byte("ping"))
+}
+
+func TestPeersDialEachOther(t *testing.T) {
+	addr := hostAddr(t, false)
+	echo := udpEcho(t, addr)
+	route := netip.PrefixFrom(addr, 32)
+
+	// Both peers expose the host, and route it to the other one, so every flow is forwarded by
+	// the remote peer
+	l1, l2 := net.Pipe()
+	a := newTestPeer(t, l1, "10.50.0.1/24", "fd50::1/64", route.String())
+	b := newTestPeer(t, l2, "10.50.0.2/24", "fd50::2/64", route.String())
+	require.NoError(t, a.SetExitRoutes(a.nicId, []netip.Prefix{route}, 0))
+	require.NoError(t, b.SetExitRoutes(b.nicId, []netip.Prefix{route}, 0))
+	requirePeerEcho(t, a, echo)
+	requirePeerEcho(t, b, echo)
+
+	// Once b withdraws the host, a can't reach it anymore
+	require.NoError(t, b.WithdrawRoutes([]string{route.String()}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := a.Net().DialContext(ctx, "udp", echo.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(500*time.Millisecond)))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 16))
+	require.Error(t, err)
+}
+
+// ping sends an echo request to the address from the interface's netstack and waits for the reply.
+func ping(t *testing.T, v *Interface, addr netip.Addr) {
+	// The netstack sets the identifier and the checksum
+	transProto, netProto := icmp.ProtocolNumber4, tcpip.NetworkProtocolNumber(ipv4.ProtocolNumber)
+	msg := make([]byte, header.ICMPv4MinimumSize+4)
+	header.ICMPv4(msg).SetType(header.ICMPv4Echo)
+	header.ICMPv4(msg).SetSequence(1)
+	if addr.Is6() {
+		transProto, netProto = icmp.ProtocolNumber6, ipv6.ProtocolNumber
+		msg = make([]byte, header.ICMPv6MinimumSize+4)
+		header.ICMPv6(msg).SetType(header.ICMPv6EchoRequest)
+		header.ICMPv6(msg).SetSequence(1)
+	}
+	copy(msg[len(msg)-4:], "ping")
+
+	var wq waiter.Queue
+	ep, tcpErr := v.Stack.NewEndpoint(transProto, netProto, &wq)
+	require.Nil(t, tcpErr)
+	defer ep.Close()
+	entry, readable := waiter.NewChannelEntry(waiter.ReadableEvents)
+	wq.EventRegister(&entry)
+	defer wq.EventUnregister(&entry)
+
+	_, tcpErr = ep.Write(bytes.NewReader(msg), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: tcpip.Address(addr.AsSlice())}})
+	require.Nil(t, tcpErr)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		var reply bytes.Buffer
+		_, tcpErr = ep.Read(&reply, tcpip.ReadOptions{})
+		if _, ok := tcpErr.(*tcpip.ErrWouldBlock); ok {
+			select {
+			case <-readable:
+				continue
+			case <-timeout:
+				require.Fail(t, "timed out waiting for echo reply")
+			}
+		}
+		require.Nil(t, tcpErr)
+		require.Equal(t, "ping", string(reply.Bytes()[reply.Len()-4:]))
+		return
+	}
+}
+
+func TestExitForwardsEcho(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		t.Run(map[bool]string{false: "ipv4", true: "ipv6"}[ipv6], func(t *testing.T) {
+			addr := hostAddr(t, ipv6)
+			network, address := "udp4", "0.0.0.0"
+			if ipv6 {
+				network, address = "udp6", "::"
+			}
+			conn, err := xicmp.ListenPacket(network, address)
+			if err != nil {
+				t.Skipf("ping sockets aren't allowed, see net.ipv4.ping_group_range: %v", err)
+			}
+			_ = conn.Close()
+
+			en, _ := newTestPair(t, Config{}, Config{}, netip.PrefixFrom(addr, addr.BitLen()).String())
+			ping(t, en, addr)
+		})
+	}
+}
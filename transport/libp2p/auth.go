@@ -0,0 +1,120 @@
+package transportp2p
+
+import (
+	"errors"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"net/netip"
+)
+
+// ErrUnauthorized is returned when dialing a peer that the transport's Authorizer rejects.
+var ErrUnauthorized = errors.New("peer not authorized")
+
+// Authorizer decides whether a remote peer is allowed to use the transport.
+type Authorizer func(id peer.ID) bool
+
+// AllowPeers returns an Authorizer that only authorizes the provided peers.
+func AllowPeers(ids ...peer.ID) Authorizer {
+	allowed := make(map[peer.ID]struct{}, len(ids))
+	for _, id := range ids {
+		allowed[id] = struct{}{}
+	}
+	return func(id peer.ID) bool {
+		_, ok := allowed[id]
+		return ok
+	}
+}
+
+// WithAuthorizer only accepts streams from peers that are authorized by the Authorizer.
+func WithAuthorizer(authorize Authorizer) Option {
+	return func(o *Config) {
+		o.Authorize = authorize
+	}
+}
+
+// WithAllowedPeers only accepts streams from the provided peers.
+func WithAllowedPeers(ids ...peer.ID) Option {
+	return WithAuthorizer(AllowPeers(ids...))
+}
+
+// WithPeerRoutes restricts the destinations that the peer's packets may be addressed to.
+// Packets from the peer that are addressed to anything outside the prefixes are dropped
+// before they reach the netstack. Once any peer has routes, peers without routes of their
+// own may only reach the prefixes set with WithDefaultPeerRoutes, if any.
+func WithPeerRoutes(id peer.ID, prefixes ...netip.Prefix) Option {
+	return func(o *Config) {
+		if o.PeerRoutes == nil {
+			o.PeerRoutes = map[peer.ID][]netip.Prefix{}
+		}
+		o.PeerRoutes[id] = append(o.PeerRoutes[id], prefixes...)
+	}
+}
+
+// WithDefaultPeerRoutes restricts the destinations of peers that weren't given routes with
+// WithPeerRoutes. Without prefixes, their packets are all dropped.
+func WithDefaultPeerRoutes(prefixes ...netip.Prefix) Option {
+	return func(o *Config) {
+		o.DefaultPeerRoutes = append([]netip.Prefix{}, prefixes...)
+	}
+}
+
+// authorized returns whether the peer may use the transport.
+func (t *Transport) authorized(id peer.ID) bool {
+	return t.authorize == nil || t.authorize(id)
+}
+
+// permitted returns whether the peer may send packets addressed to dst. Peers aren't
+// restricted unless per-peer or default routes are configured.
+func (t *Transport) permitted(id peer.ID, dst netip.Addr) bool {
+	prefixes, ok := t.peerRoutes[id]
+	if !ok {
+		if t.defaultRoutes == nil && len(t.peerRoutes) == 0 {
+			return true
+		}
+		prefixes = t.defaultRoutes
+	}
+	for _, p := range prefixes {
+		if p.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectionGater returns a libp2p connection gater that only allows connections to and
+// from peers that are authorized by the Authorizer. Pass it to libp2p.ConnectionGater
+// when constructing the host to reject unauthorized peers before any streams are opened.
+// Note that the gater applies to every protocol on the host, not just the transport.
+func ConnectionGater(authorize Authorizer) connmgr.ConnectionGater {
+	return &gater{authorize: authorize}
+}
+
+var _ connmgr.ConnectionGater = &gater{}
+
+// gater is a connmgr.ConnectionGater that gates connections using an Authorizer.
+type gater struct {
+	authorize Authorizer
+}
+
+func (g *gater) InterceptPeerDial(p peer.ID) bool {
+	return g.authorize(p)
+}
+
+func (g *gater) InterceptAddrDial(p peer.ID, _ ma.Multiaddr) bool {
+	return g.authorize(p)
+}
+
+func (g *gater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g *gater) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	return g.authorize(p)
+}
+
+func (g *gater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,143 @@
+package transportp2p
+
+import (
+	"context"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTransportRejectsUnauthorizedPeers(t *testing.T) {
+	allowed, other := newTestHost(t), newTestHost(t)
+	exit := newTestExit(t, WithAllowedPeers(allowed.ID()))
+
+	tr, err := New(allowed, nil)
+	require.NoError(t, err)
+	l, err := dial(t, allowed, tr, exit.host)
+	require.NoError(t, err)
+	p := ipv4Packet("100.64.0.2", "192.0.2.1", 1)
+	_, err = l.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, exit.packets, p)
+
+	// The exit resets the streams of other peers without reading from them
+	tr, err = New(other, nil)
+	require.NoError(t, err)
+	l, err = dial(t, other, tr, exit.host)
+	require.NoError(t, err)
+	_, _ = l.Write(ipv4Packet("100.64.0.3", "192.0.2.1", 2))
+	requireNoPacket(t, exit.packets)
+	_ = l.Close()
+}
+
+func TestTransportRejectsUnauthorizedDials(t *testing.T) {
+	exit := newTestExit(t)
+	h := newTestHost(t)
+	tr, err := New(h, channel.New(64, 1500, ""), WithAllowedPeers())
+	require.NoError(t, err)
+	_, err = dial(t, h, tr, exit.host)
+	require.ErrorIs(t, err, ErrUnauthorized)
+	_, err = tr.Dial(context.Background(), exit.host.ID())
+	require.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestTransportRejectsUnauthorizedSubscriptions(t *testing.T) {
+	exit := newTestExit(t)
+	exit.transport.AdvertiseRoutes([]netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")})
+	h := newTestHost(t)
+	tr, err := New(h, nil, WithAllowedPeers())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: exit.host.ID(), Addrs: exit.host.Addrs()}))
+	require.ErrorIs(t, tr.SubscribeRoutes(ctx, exit.host.ID()), ErrUnauthorized)
+	require.Empty(t, tr.RemoteRoutes())
+}
+
+func TestTransportPeerRoutes(t *testing.T) {
+	a, b := newTestHost(t), newTestHost(t)
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		allowedB bool // Whether B, which has no routes of its own, can reach 192.0.2.1
+	}{
+		{"no default", []Option{WithPeerRoutes(a.ID(), netip.MustParsePrefix("10.1.0.0/16"))}, false},
+		{"default", []Option{
+			WithPeerRoutes(a.ID(), netip.MustParsePrefix("10.1.0.0/16")),
+			WithDefaultPeerRoutes(netip.MustParsePrefix("192.0.2.0/24")),
+		}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exit := newTestExit(t, tc.opts...)
+			ta, err := New(a, nil)
+			require.NoError(t, err)
+			la, err := dial(t, a, ta, exit.host)
+			require.NoError(t, err)
+			defer la.Close()
+			tb, err := New(b, nil)
+			require.NoError(t, err)
+			lb, err := dial(t, b, tb, exit.host)
+			require.NoError(t, err)
+			defer lb.Close()
+
+			// A can only reach its own routes
+			_, err = la.Write(ipv4Packet("100.64.0.2", "192.0.2.1", 1))
+			require.NoError(t, err)
+			requireNoPacket(t, exit.packets)
+			p := ipv4Packet("100.64.0.2", "10.1.2.3", 2)
+			_, err = la.Write(p)
+			require.NoError(t, err)
+			requirePacket(t, exit.packets, p)
+
+			// B can only reach the default routes
+			p = ipv4Packet("100.64.0.3", "192.0.2.1", 3)
+			_, err = lb.Write(p)
+			require.NoError(t, err)
+			if tc.allowedB {
+				requirePacket(t, exit.packets, p)
+			} else {
+				requireNoPacket(t, exit.packets)
+			}
+			_, err = lb.Write(ipv4Packet("100.64.0.3", "10.1.2.3", 4))
+			require.NoError(t, err)
+			requireNoPacket(t, exit.packets)
+		})
+	}
+}
+
+func TestTransportPeerRoutesOfDialedPeers(t *testing.T) {
+	exit := newTestExit(t)
+	h := newTestHost(t)
+	ep := channel.New(64, 1500, "")
+	tr, err := New(h, ep, WithPeerRoutes(exit.host.ID(), netip.MustParsePrefix("100.64.0.0/24")))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+	link := netstack.NewChannelLink(ep)
+	t.Cleanup(func() { _ = link.Close() })
+	packets := readPackets(link)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: exit.host.ID(), Addrs: exit.host.Addrs()}))
+	_, err = tr.Dial(ctx, exit.host.ID())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(exit.transport.Sessions()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Packets from the dialed peer are only written to the endpoint if they're addressed to
+	// its routes
+	_, err = exit.link.Write(ipv4Packet("192.0.2.1", "10.9.9.9", 1))
+	require.NoError(t, err)
+	requireNoPacket(t, packets)
+	p := ipv4Packet("192.0.2.1", "100.64.0.2", 2)
+	_, err = exit.link.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, packets, p)
+}
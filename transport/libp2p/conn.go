@@ -0,0 +1,233 @@
+package transportp2p
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/clarkmcc/remotenetstack/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+	"go.uber.org/zap"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ProtocolV1 defines the libp2p protocol ID of the bidirectional successor to Protocol.
+// Every message is wrapped in a frame that identifies the type of the message, which lets
+// both peers exchange control messages, keepalives, route updates and close reasons over
+// the same stream as the packets. Streams are opened with both protocol IDs, so peers
+// that only support Protocol keep working.
+const ProtocolV1 = "/rns/packet/1.0.0"
+
+// KeepaliveInterval is how often keepalives are sent over ProtocolV1 streams. A stream
+// that doesn't receive anything for three intervals is considered dead and is reset.
+const KeepaliveInterval = 15 * time.Second
+
+// frameHeaderSize is the size of the header that precedes every frame. The header is the
+// message type followed by the length of the payload as a big endian uint16.
+const frameHeaderSize = 3
+
+// MessageType identifies the type of message carried by a ProtocolV1 frame.
+type MessageType uint8
+
+const (
+	MessageData      MessageType = iota + 1 // An IP packet
+	MessageControl                          // A control message, reserved for future use and ignored if unknown
+	MessageKeepalive                        // Sent periodically to detect dead streams, has no payload
+	MessageRoutes                           // The routes advertised by the sender, encoded as JSON
+	MessageClose                            // The reason why the sender is closing the stream
+)
+
+func (m MessageType) String() string {
+	switch m {
+	case MessageData:
+		return "data"
+	case MessageControl:
+		return "control"
+	case MessageKeepalive:
+		return "keepalive"
+	case MessageRoutes:
+		return "routes"
+	case MessageClose:
+		return "close"
+	default:
+		return "unknown"
+	}
+}
+
+// CloseError is returned when reading from a stream that the remote peer closed.
+type CloseError struct {
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("stream closed by peer: %s", e.Reason)
+}
+
+// packetConn reads and writes packets over a stream using whichever protocol was
+// negotiated for the stream. ProtocolV1 streams exchange framed messages, Protocol
+// streams carry raw packets.
+type packetConn struct {
+	stream   network.Stream
+	framed   bool
+	reader   *bufio.Reader
+	logger   *zap.Logger
+	onRoutes func(routes []netip.Prefix)
+
+	wmu       sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newPacketConn wraps the stream and starts sending keepalives if the stream uses
+// ProtocolV1. Routes received from the remote peer are passed to onRoutes.
+func newPacketConn(s network.Stream, logger *zap.Logger, onRoutes func(routes []netip.Prefix)) *packetConn {
+	c := &packetConn{
+		stream:   s,
+		framed:   s.Protocol() == ProtocolV1,
+		logger:   logger,
+		onRoutes: onRoutes,
+		done:     make(chan struct{}),
+	}
+	if c.framed {
+		c.reader = bufio.NewReader(s)
+		go c.keepalive()
+	}
+	return c
+}
+
+// Read reads the next packet from the stream. Messages other than packets are handled
+// as they're read.
+func (c *packetConn) Read(p []byte) (n int, err error) {
+	if !c.framed {
+		return c.stream.Read(p)
+	}
+	var header [frameHeaderSize]byte
+	for {
+		_ = c.stream.SetReadDeadline(time.Now().Add(3 * KeepaliveInterval))
+		if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+			return 0, err
+		}
+		typ := MessageType(header[0])
+		size := int(binary.BigEndian.Uint16(header[1:]))
+		if typ == MessageData && size <= len(p) {
+			return io.ReadFull(c.reader, p[:size])
+		}
+		payload := utils.GetBuf(size)
+		_, err = io.ReadFull(c.reader, payload)
+		if err == nil {
+			err = c.handle(typ, payload, p, &n)
+		}
+		utils.PutBuf(payload)
+		if err != nil || n > 0 {
+			return n, err
+		}
+	}
+}
+
+// handle handles a message other than a packet that fits in the caller's buffer.
+func (c *packetConn) handle(typ MessageType, payload []byte, p []byte, n *int) error {
+	switch typ {
+	case MessageData:
+		// A truncated packet would be corrupt, so packets that don't fit in the caller's
+		// buffer are dropped
+		c.logger.Debug("dropping packet larger than the read buffer",
+			zap.Int("bytes", len(payload)), zap.Int("buffer", len(p)))
+	case MessageKeepalive:
+	case MessageRoutes:
+		var msg routesMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			c.logger.Warn("decoding routes", zap.Error(err))
+			return nil
+		}
+		if c.onRoutes != nil {
+			c.onRoutes(msg.Routes)
+		}
+	case MessageClose:
+		return &CloseError{Reason: string(payload)}
+	default:
+		c.logger.Debug("ignoring message", zap.Stringer("type", typ), zap.Int("bytes", len(payload)))
+	}
+	return nil
+}
+
+// Write writes the packet to the stream.
+func (c *packetConn) Write(p []byte) (n int, err error) {
+	if !c.framed {
+		return c.stream.Write(p)
+	}
+	if err = c.writeFrame(MessageData, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SendRoutes advertises the routes to the remote peer. Routes can't be sent over
+// Protocol streams, where they have to be advertised using RoutesProtocol instead.
+func (c *packetConn) SendRoutes(routes []netip.Prefix) error {
+	if !c.framed {
+		return nil
+	}
+	b, err := json.Marshal(routesMessage{Routes: routes})
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(MessageRoutes, b)
+}
+
+// writeFrame writes a single frame containing the message to the stream.
+func (c *packetConn) writeFrame(typ MessageType, payload []byte) error {
+	if len(payload) > 0xffff {
+		return fmt.Errorf("%s message of %d bytes is too large", typ, len(payload))
+	}
+	buf := utils.GetBuf(frameHeaderSize + len(payload))
+	defer utils.PutBuf(buf)
+	buf[0] = byte(typ)
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.stream.Write(buf)
+	return err
+}
+
+// keepalive periodically sends keepalives until the connection is closed.
+func (c *packetConn) keepalive() {
+	ticker := time.NewTicker(KeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writeFrame(MessageKeepalive, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Close tells the remote peer why the stream is being closed, if the protocol supports
+// it, and then closes the stream.
+func (c *packetConn) Close(reason string) error {
+	c.stop()
+	if c.framed {
+		_ = c.writeFrame(MessageClose, []byte(reason))
+	}
+	return c.stream.Close()
+}
+
+// Reset resets the stream without telling the remote peer why.
+func (c *packetConn) Reset() error {
+	c.stop()
+	return c.stream.Reset()
+}
+
+func (c *packetConn) stop() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
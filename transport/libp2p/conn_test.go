@@ -0,0 +1,53 @@
+package transportp2p
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"testing"
+	"time"
+)
+
+// bufferStream is a ProtocolV1 stream that reads from a buffer.
+type bufferStream struct {
+	network.Stream
+	r io.Reader
+}
+
+func (s *bufferStream) Read(p []byte) (int, error)        { return s.r.Read(p) }
+func (s *bufferStream) Protocol() protocol.ID             { return ProtocolV1 }
+func (s *bufferStream) SetReadDeadline(_ time.Time) error { return nil }
+
+// frame encodes a ProtocolV1 frame.
+func frame(typ MessageType, payload []byte) []byte {
+	b := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	b[0] = byte(typ)
+	binary.BigEndian.PutUint16(b[1:], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func TestPacketConnDropsOversizedPackets(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(frame(MessageData, bytes.Repeat([]byte{1}, 100)))
+	buf.Write(frame(MessageData, []byte{2, 2}))
+	c := &packetConn{
+		stream: &bufferStream{r: &buf},
+		framed: true,
+		reader: bufio.NewReader(&buf),
+		logger: zap.NewNop(),
+		done:   make(chan struct{}),
+	}
+
+	// Packets that don't fit are skipped rather than truncated
+	p := make([]byte, 10)
+	n, err := c.Read(p)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2, 2}, p[:n])
+	_, err = c.Read(p)
+	require.ErrorIs(t, err, io.EOF)
+}
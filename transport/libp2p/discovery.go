@@ -0,0 +1,183 @@
+package transportp2p
+
+import (
+	"context"
+	"errors"
+	"github.com/ipfs/go-cid"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-multihash"
+	"go.uber.org/zap"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DiscoveryProtocolPrefix is the protocol prefix of the DHT created by NewDHT. Using our
+// own prefix keeps the DHT private to remote-netstack peers rather than joining the public
+// IPFS DHT.
+const DiscoveryProtocolPrefix = "/rns"
+
+// routeKeyPrefix namespaces the provider records of exposed routes in the DHT.
+const routeKeyPrefix = "/rns/route/"
+
+// maxConcurrentLookups is how many of the prefixes covering a destination FindExits looks up
+// at the same time.
+const maxConcurrentLookups = 8
+
+// NewDHT creates a private DHT on the host that can be used for exit discovery, and joins
+// it by connecting to the bootstrap peers. Without any bootstrap peers, the host starts a
+// new DHT that other peers can join by bootstrapping from it.
+func NewDHT(ctx context.Context, h host.Host, bootstrap ...peer.AddrInfo) (*dht.IpfsDHT, error) {
+	d, err := dht.New(ctx, h,
+		dht.Mode(dht.ModeServer),
+		dht.ProtocolPrefix(DiscoveryProtocolPrefix),
+		dht.BootstrapPeers(bootstrap...))
+	if err != nil {
+		return nil, err
+	}
+	var connected bool
+	for _, p := range bootstrap {
+		if err = h.Connect(ctx, p); err == nil {
+			connected = true
+		}
+	}
+	if len(bootstrap) > 0 && !connected {
+		_ = d.Close()
+		return nil, err
+	}
+	if err = d.Bootstrap(ctx); err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Discovery lets exits publish the routes that they expose as provider records in a
+// content router (typically the DHT returned by NewDHT), and lets entrances resolve a
+// destination to the exits that can reach it.
+type Discovery struct {
+	router routing.ContentRouting
+	logger *zap.Logger
+}
+
+// NewDiscovery creates a Discovery that publishes and resolves routes using the router.
+func NewDiscovery(router routing.ContentRouting, opts ...Option) *Discovery {
+	cfg := Config{
+		Logger: zap.NewNop(),
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &Discovery{
+		router: router,
+		logger: cfg.Logger.Named("discovery"),
+	}
+}
+
+// Advertise publishes a provider record for each of the prefixes, announcing that this
+// host is an exit for them. Provider records expire, so exits should keep re-advertising
+// their routes using AdvertiseEvery.
+func (d *Discovery) Advertise(ctx context.Context, prefixes []netip.Prefix) error {
+	for _, p := range prefixes {
+		key, err := routeKey(p)
+		if err != nil {
+			return err
+		}
+		d.logger.Debug("advertising route", zap.String("route", p.String()))
+		if err = d.router.Provide(ctx, key, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AdvertiseEvery advertises the prefixes returned by the function immediately, and then
+// again every interval until ctx is canceled. Failures are logged and retried on the next
+// interval.
+func (d *Discovery) AdvertiseEvery(ctx context.Context, interval time.Duration, prefixes func() []netip.Prefix) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Advertise(ctx, prefixes()); err != nil && ctx.Err() == nil {
+			d.logger.Warn("advertising routes", zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// FindExits returns the exits that advertise a route covering the destination prefix,
+// ordered from the most to the least specific route. Each of the prefixes covering the
+// destination is looked up, up to maxConcurrentLookups at a time, returning at most limit
+// exits for each of them (zero means no limit).
+func (d *Discovery) FindExits(ctx context.Context, dst netip.Prefix, limit int) ([]peer.AddrInfo, error) {
+	if !dst.IsValid() {
+		return nil, errors.New("invalid destination prefix")
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	found := map[peer.ID]peer.AddrInfo{}
+	best := map[peer.ID]int{}
+	sem := make(chan struct{}, maxConcurrentLookups)
+lookups:
+	for bits := dst.Bits(); bits >= 0; bits-- {
+		p := netip.PrefixFrom(dst.Addr(), bits).Masked()
+		key, err := routeKey(p)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break lookups
+		}
+		wg.Add(1)
+		go func(bits int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			for info := range d.router.FindProvidersAsync(ctx, key, limit) {
+				mu.Lock()
+				if b, ok := best[info.ID]; !ok || bits > b {
+					best[info.ID] = bits
+				}
+				if len(info.Addrs) > 0 || len(found[info.ID].Addrs) == 0 {
+					found[info.ID] = info
+				}
+				mu.Unlock()
+			}
+		}(bits)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil && len(found) == 0 {
+		return nil, err
+	}
+
+	exits := make([]peer.AddrInfo, 0, len(found))
+	for _, info := range found {
+		exits = append(exits, info)
+	}
+	sort.Slice(exits, func(i, j int) bool {
+		bi, bj := best[exits[i].ID], best[exits[j].ID]
+		if bi == bj {
+			return exits[i].ID < exits[j].ID
+		}
+		return bi > bj
+	})
+	return exits, nil
+}
+
+// routeKey returns the key of the provider records for the prefix.
+func routeKey(p netip.Prefix) (cid.Cid, error) {
+	h, err := multihash.Sum([]byte(routeKeyPrefix+p.Masked().String()), multihash.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, h), nil
+}
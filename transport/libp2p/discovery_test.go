@@ -0,0 +1,68 @@
+package transportp2p
+
+import (
+	"context"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryFindsExits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Every host joins a private DHT by bootstrapping from the hosts created before it
+	var infos []peer.AddrInfo
+	var dhts []*dht.IpfsDHT
+	for i := 0; i < 5; i++ {
+		h := newTestHost(t)
+		d, err := NewDHT(ctx, h, infos...)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = d.Close() })
+		infos = append(infos, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+		dhts = append(dhts, d)
+	}
+	require.Eventually(t, func() bool {
+		for _, d := range dhts {
+			if d.RoutingTable().Size() == 0 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Two exits advertise overlapping routes
+	require.NoError(t, NewDiscovery(dhts[1]).Advertise(ctx, []netip.Prefix{
+		netip.MustParsePrefix("10.20.0.0/16"),
+	}))
+	require.NoError(t, NewDiscovery(dhts[2]).Advertise(ctx, []netip.Prefix{
+		netip.MustParsePrefix("10.20.5.0/24"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+	}))
+
+	// Exits are ordered from the most to the least specific route
+	d := NewDiscovery(dhts[4])
+	exits, err := d.FindExits(ctx, netip.MustParsePrefix("10.20.5.7/32"), 0)
+	require.NoError(t, err)
+	require.Len(t, exits, 2)
+	require.Equal(t, infos[2].ID, exits[0].ID)
+	require.Equal(t, infos[1].ID, exits[1].ID)
+	require.NotEmpty(t, exits[0].Addrs)
+
+	exits, err = d.FindExits(ctx, netip.MustParsePrefix("10.20.6.0/24"), 1)
+	require.NoError(t, err)
+	require.Len(t, exits, 2)
+	require.Equal(t, infos[1].ID, exits[0].ID)
+	require.Equal(t, infos[2].ID, exits[1].ID)
+
+	exits, err = d.FindExits(ctx, netip.MustParsePrefix("192.0.2.1/32"), 0)
+	require.NoError(t, err)
+	require.Len(t, exits, 1)
+	require.Equal(t, infos[2].ID, exits[0].ID)
+
+	_, err = d.FindExits(ctx, netip.Prefix{}, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,204 @@
+package transportp2p
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// HostOption is a function that knows how to customize the HostConfig struct.
+type HostOption func(*HostConfig)
+
+// WithIdentity loads the host's private key from the file at path. If the file doesn't
+// exist, a new Ed25519 key is generated and persisted there.
+func WithIdentity(path string) HostOption {
+	return func(o *HostConfig) {
+		o.IdentityPath = path
+	}
+}
+
+// WithListenAddrs sets the multiaddrs that the host listens on.
+func WithListenAddrs(addrs ...string) HostOption {
+	return func(o *HostConfig) {
+		o.ListenAddrs = addrs
+	}
+}
+
+// WithRelays lets the host reserve slots on the provided relays so that it can be reached
+// when it's behind a NAT.
+func WithRelays(relays ...peer.AddrInfo) HostOption {
+	return func(o *HostConfig) {
+		o.Relays = relays
+	}
+}
+
+// WithRelayService lets the host act as a relay for other peers.
+func WithRelayService() HostOption {
+	return func(o *HostConfig) {
+		o.RelayService = true
+	}
+}
+
+// WithHolePunching lets the host attempt to upgrade relayed connections to direct
+// connections using hole punching.
+func WithHolePunching() HostOption {
+	return func(o *HostConfig) {
+		o.HolePunching = true
+	}
+}
+
+// WithNATPortMap lets the host open a port in the NAT's firewall using UPnP.
+func WithNATPortMap() HostOption {
+	return func(o *HostConfig) {
+		o.NATPortMap = true
+	}
+}
+
+// WithHostAuthorizer only allows connections to and from the peers authorized by the
+// Authorizer using ConnectionGater.
+func WithHostAuthorizer(authorize Authorizer) HostOption {
+	return func(o *HostConfig) {
+		o.Authorize = authorize
+	}
+}
+
+// WithLibp2pOptions appends raw libp2p options to the options derived from the HostConfig.
+// libp2p rejects options that can only be set once, such as a second Identity or
+// ConnectionGater, so NewHost fails if they're also derived from the HostConfig.
+func WithLibp2pOptions(opts ...libp2p.Option) HostOption {
+	return func(o *HostConfig) {
+		o.Options = append(o.Options, opts...)
+	}
+}
+
+type HostConfig struct {
+	IdentityPath string          // Path of the host's private key, an ephemeral key is used when empty
+	ListenAddrs  []string        // Multiaddrs to listen on, the libp2p defaults are used when empty
+	Relays       []peer.AddrInfo // Static relays used to reach the host when it's behind a NAT
+	RelayService bool            // Whether the host acts as a relay for other peers
+	HolePunching bool            // Whether to upgrade relayed connections using hole punching
+	NATPortMap   bool            // Whether to open a port in the NAT's firewall using UPnP
+	Authorize    Authorizer      // Decides which peers may connect, all peers are allowed when nil
+	Options      []libp2p.Option // Additional libp2p options
+}
+
+// NewHost creates a libp2p host that's suitable for running the transport in production.
+// Unlike MakeTestHost, connections are secured using Noise or TLS, and the resource manager
+// limits are sized for the small number of long-lived, high-throughput streams that the
+// transport opens to each peer.
+func NewHost(opts ...HostOption) (host.Host, error) {
+	cfg := HostConfig{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	var priv crypto.PrivKey
+	var err error
+	if cfg.IdentityPath != "" {
+		priv, err = LoadIdentity(cfg.IdentityPath)
+	} else {
+		priv, _, err = crypto.GenerateEd25519Key(rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	limits := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&limits)
+	for _, p := range []string{ProtocolV1, Protocol, RoutesProtocol} {
+		limits.AddProtocolLimit(protocol.ID(p), rcmgr.BaseLimit{
+			Streams:         1024,
+			StreamsInbound:  1024,
+			StreamsOutbound: 1024,
+			Memory:          256 << 20,
+		}, rcmgr.BaseLimitIncrease{
+			Streams:         512,
+			StreamsInbound:  512,
+			StreamsOutbound: 512,
+			Memory:          128 << 20,
+		})
+		limits.AddProtocolPeerLimit(protocol.ID(p), rcmgr.BaseLimit{
+			Streams:         8,
+			StreamsInbound:  4,
+			StreamsOutbound: 4,
+			Memory:          32 << 20,
+		}, rcmgr.BaseLimitIncrease{})
+	}
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits.AutoScale()))
+	if err != nil {
+		return nil, err
+	}
+
+	options := []libp2p.Option{
+		libp2p.Identity(priv),
+		libp2p.Security(noise.ID, noise.New),
+		libp2p.Security(libp2ptls.ID, libp2ptls.New),
+		libp2p.ResourceManager(rm),
+	}
+	if len(cfg.ListenAddrs) > 0 {
+		options = append(options, libp2p.ListenAddrStrings(cfg.ListenAddrs...))
+	}
+	if len(cfg.Relays) > 0 {
+		options = append(options, libp2p.EnableAutoRelay(autorelay.WithStaticRelays(cfg.Relays)))
+	}
+	if cfg.RelayService {
+		options = append(options, libp2p.EnableRelayService())
+	}
+	if cfg.HolePunching {
+		options = append(options, libp2p.EnableHolePunching())
+	}
+	if cfg.NATPortMap {
+		options = append(options, libp2p.NATPortMap())
+	}
+	if cfg.Authorize != nil {
+		options = append(options, libp2p.ConnectionGater(ConnectionGater(cfg.Authorize)))
+	}
+	options = append(options, cfg.Options...)
+
+	h, err := libp2p.New(options...)
+	if err != nil {
+		_ = rm.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// LoadIdentity loads a private key from the file at path. If the file doesn't exist, a new
+// Ed25519 key is generated and written to the file so that the host keeps the same peer ID
+// across restarts.
+func LoadIdentity(path string) (crypto.PrivKey, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return crypto.UnmarshalPrivateKey(b)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	b, err = crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
@@ -0,0 +1,77 @@
+package transportp2p
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	path := filepath.Join(dir, "host.key")
+
+	// The key is created, along with its directory, and only its owner can read it
+	priv, err := LoadIdentity(path)
+	require.NoError(t, err)
+	require.Equal(t, crypto.Ed25519, int(priv.Type()))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// And the same key is loaded again
+	again, err := LoadIdentity(path)
+	require.NoError(t, err)
+	require.True(t, priv.Equals(again))
+
+	require.NoError(t, os.WriteFile(path, []byte("not a key"), 0600))
+	_, err = LoadIdentity(path)
+	require.Error(t, err)
+}
+
+func TestNewHost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "host.key")
+	newHost := func(opts ...HostOption) host.Host {
+		h, err := NewHost(append(opts, WithListenAddrs("/ip4/127.0.0.1/tcp/0"))...)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = h.Close() })
+		return h
+	}
+
+	// The host's peer ID is derived from its identity, so it survives restarts
+	h := newHost(WithIdentity(path))
+	priv, err := LoadIdentity(path)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+	require.Equal(t, id, h.ID())
+	require.NoError(t, h.Close())
+	h = newHost(WithIdentity(path))
+	require.Equal(t, id, h.ID())
+
+	// Authorized peers can connect over the secured transports, other peers are gated
+	gated := newHost(WithHostAuthorizer(AllowPeers(id)))
+	other := newHost()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: gated.ID(), Addrs: gated.Addrs()}))
+	require.Error(t, other.Connect(ctx, peer.AddrInfo{ID: gated.ID(), Addrs: gated.Addrs()}))
+	require.NoError(t, other.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}))
+}
+
+func TestNewHostRejectsDuplicateOptions(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	_, err = NewHost(WithLibp2pOptions(libp2p.Identity(priv)))
+	require.Error(t, err)
+}
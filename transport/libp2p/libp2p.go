@@ -1,18 +1,27 @@
 package transportp2p
 
 import (
+	"context"
+	"errors"
 	"github.com/clarkmcc/remotenetstack/netstack"
-	"github.com/clarkmcc/remotenetstack/utils"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"go.uber.org/zap"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"net/netip"
+	"sync"
+	"time"
 )
 
 // Protocol defines a libp2p protocol ID that can be used by clients and servers to
-// identify the p2p remote-netstack transport.
+// identify the p2p remote-netstack transport. It's superseded by ProtocolV1 but still
+// accepted so that older peers can connect.
 const Protocol = "/rns/one-way/0.0.1"
 
+// ErrClosed is returned when using a Transport that has been closed.
+var ErrClosed = errors.New("transport closed")
+
 // Option is a function that knows how to customize the Config struct.
 type Option func(*Config)
 
@@ -23,32 +32,111 @@ func WithLogger(logger *zap.Logger) Option {
 }
 
 type Config struct {
-	Logger *zap.Logger
+	Logger            *zap.Logger
+	Authorize         Authorizer                              // Decides which peers may use the transport, all peers are allowed when nil
+	PeerRoutes        map[peer.ID][]netip.Prefix              // Destinations that each peer's packets may be addressed to
+	DefaultPeerRoutes []netip.Prefix                          // Destinations of peers without PeerRoutes, unrestricted when nil and PeerRoutes is empty
+	OnRoutes          func(id peer.ID, routes []netip.Prefix) // Called when a subscribed peer advertises new routes
 }
 
 // Transport is a p2p transport based on libp2p that uses a netstack endpoint
-// as the data link layer.
+// as the data link layer. Any number of remote peers can be attached to the
+// endpoint at the same time, packets read from the endpoint are routed to the
+// peer that owns the packet's destination address.
 type Transport struct {
-	host   host.Host
-	ep     *netstack.Endpoint
-	logger *zap.Logger
+	host          host.Host
+	ep            *netstack.Endpoint
+	logger        *zap.Logger
+	authorize     Authorizer
+	peerRoutes    map[peer.ID][]netip.Prefix
+	defaultRoutes []netip.Prefix  // Destinations of peers without peerRoutes
+	ctx           context.Context // Canceled when the transport is closed
+	cancel        context.CancelFunc
+
+	mu       sync.Mutex
+	sessions map[*session]struct{}   // Remote peers attached to the endpoint
+	links    map[*Link]struct{}      // Links dialed by the transport
+	routes   map[netip.Addr]*session // Addresses learned from the packets received from each session
+
+	conns        map[*packetConn]struct{}         // ProtocolV1 connections that routes are advertised to
+	advertised   []netip.Prefix                   // Routes advertised to subscribers
+	subscribers  map[network.Stream]chan struct{} // Subscribers to notify when the advertised routes change
+	remoteRoutes map[peer.ID]map[any]routeSource  // Routes advertised by each peer over each of its streams
+	routesSeq    uint64                           // Orders the updates of remoteRoutes
+	installers   map[peer.ID]*routeInstaller      // Route tables that the routes of each peer are installed into
+	onRoutes     func(id peer.ID, routes []netip.Prefix)
 }
 
-// handler handles new streams over the p2p transport. It copies all bytes
-// received from the stream to the netstack.Endpoint and reads all packets
-// from the netstack.Endpoint and writes them to the stream. This is only
-// utilized by the server side of the transport (the netstack that we're
-// trying to talk through).
+// handler handles new streams over the p2p transport. It copies all packets
+// received from the stream to the netstack.Endpoint, and the packets that
+// the netstack.Endpoint addresses to the stream's peer are written back to
+// the stream. This is only utilized by the server side of the transport (the
+// netstack that we're trying to talk through).
 func (t *Transport) handler(s network.Stream) {
-	t.logger.Debug("accepting stream",
+	logger := t.logger.With(
 		zap.String("id", s.ID()),
 		zap.String("peer_id", s.Conn().RemotePeer().String()),
 		zap.String("peer_addr", s.Conn().RemoteMultiaddr().String()))
-	utils.Join(t.ep, s)
+	if !t.authorized(s.Conn().RemotePeer()) {
+		logger.Warn("rejecting stream from unauthorized peer")
+		_ = s.Reset()
+		return
+	}
+	if t.ctx.Err() != nil {
+		_ = s.Reset()
+		return
+	}
+	logger.Debug("accepting stream", zap.String("protocol", string(s.Protocol())))
+	c := t.newConn(s, logger)
+	defer c.Reset()
+	defer t.dropConn(c)
+	t.attach(&session{
+		peer:    s.Conn().RemotePeer(),
+		rw:      c,
+		conn:    c,
+		logger:  logger,
+		started: time.Now(),
+	})
+}
+
+// newConn wraps the stream in a packetConn. ProtocolV1 connections are sent the routes
+// that we advertise, and the routes that the remote peer advertises are recorded.
+func (t *Transport) newConn(s network.Stream, logger *zap.Logger) *packetConn {
+	id := s.Conn().RemotePeer()
+	var c *packetConn
+	c = newPacketConn(s, logger, func(routes []netip.Prefix) {
+		t.setRemoteRoutes(id, c, routes)
+	})
+	if !c.framed {
+		return c
+	}
+	t.mu.Lock()
+	t.conns[c] = struct{}{}
+	advertised := t.advertised
+	t.mu.Unlock()
+	if len(advertised) > 0 {
+		if err := c.SendRoutes(advertised); err != nil {
+			logger.Debug("sending routes", zap.Error(err))
+		}
+	}
+	return c
+}
+
+// dropConn stops tracking the connection and forgets the routes advertised over it. Routes
+// that the peer advertises over other streams are kept.
+func (t *Transport) dropConn(c *packetConn) {
+	if !c.framed {
+		return
+	}
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+	t.dropRemoteRoutes(c.stream.Conn().RemotePeer(), c)
 }
 
 // New creates a new p2p transport using the given channel endpoint as the source
-// of data sent over the transport.
+// of data sent over the transport. If the endpoint is nil, the transport does not
+// accept streams and can only be used to dial links to remote peers.
 func New(h host.Host, ep *channel.Endpoint, opts ...Option) (*Transport, error) {
 	cfg := Config{
 		Logger: zap.NewNop(),
@@ -56,11 +144,73 @@ func New(h host.Host, ep *channel.Endpoint, opts ...Option) (*Transport, error)
 	for _, opt := range opts {
 		opt(&cfg)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	t := &Transport{
-		host:   h,
-		logger: cfg.Logger.Named(Protocol),
-		ep:     netstack.WrapChannel(ep),
+		host:          h,
+		ctx:           ctx,
+		cancel:        cancel,
+		logger:        cfg.Logger.Named(Protocol),
+		authorize:     cfg.Authorize,
+		peerRoutes:    cfg.PeerRoutes,
+		defaultRoutes: cfg.DefaultPeerRoutes,
+		sessions:      map[*session]struct{}{},
+		links:         map[*Link]struct{}{},
+		conns:         map[*packetConn]struct{}{},
+		routes:        map[netip.Addr]*session{},
+		subscribers:   map[network.Stream]chan struct{}{},
+		remoteRoutes:  map[peer.ID]map[any]routeSource{},
+		installers:    map[peer.ID]*routeInstaller{},
+		onRoutes:      cfg.OnRoutes,
+	}
+	if ep != nil {
+		t.ep = netstack.WrapChannel(ep)
+		t.ep.Logger = t.logger.Named("endpoint")
+		t.ep.Context = ctx
+		go t.dispatch()
+		h.SetStreamHandler(ProtocolV1, t.handler)
+		h.SetStreamHandler(Protocol, t.handler)
+		h.SetStreamHandler(RoutesProtocol, t.routesHandler)
 	}
-	h.SetStreamHandler(Protocol, t.handler)
 	return t, nil
 }
+
+// Close stops accepting streams, closes every stream accepted by the transport and every
+// link dialed by it, and ends all route subscriptions. The transport can't be used after
+// it's closed.
+func (t *Transport) Close() error {
+	if t.ctx.Err() != nil {
+		return nil
+	}
+	t.host.RemoveStreamHandler(ProtocolV1)
+	t.host.RemoveStreamHandler(Protocol)
+	t.host.RemoveStreamHandler(RoutesProtocol)
+
+	t.mu.Lock()
+	t.cancel()
+	var conns []*packetConn
+	for sess := range t.sessions {
+		if sess.conn != nil {
+			conns = append(conns, sess.conn)
+		}
+	}
+	links := make([]*Link, 0, len(t.links))
+	for l := range t.links {
+		links = append(links, l)
+	}
+	streams := make([]network.Stream, 0, len(t.subscribers))
+	for s := range t.subscribers {
+		streams = append(streams, s)
+	}
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		_ = c.Close("transport closed")
+	}
+	for _, l := range links {
+		_ = l.Close()
+	}
+	for _, s := range streams {
+		_ = s.Reset()
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package transportp2p
+
+import (
+	"context"
+	"errors"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	minReopenBackoff = 100 * time.Millisecond
+	maxReopenBackoff = 5 * time.Second
+)
+
+var _ io.ReadWriteCloser = &Link{}
+
+// Link is the client side of the p2p transport. It's a data link layer that reads and
+// writes packets over a libp2p stream to a remote peer, which means it can be used as
+// the LinkLayer of a vni.Interface. When the stream is reset or fails, the Link
+// transparently re-opens it until the Link is closed. When the remote peer closes the
+// stream, the Link is closed and reads return io.EOF.
+type Link struct {
+	t      *Transport
+	peer   peer.ID
+	logger *zap.Logger
+	ctx    context.Context // Canceled when the link is closed
+	cancel context.CancelFunc
+
+	started  time.Time
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	mu        sync.Mutex
+	conn      *packetConn
+	gen       uint64        // Incremented every time the stream is re-opened
+	reopening chan struct{} // Closed once the stream that is being re-opened is replaced
+	closed    bool
+}
+
+// DialLink opens a stream to the remote peer and returns it as a Link. The Link is not
+// attached to the Transport's endpoint, which makes it useful for passing to vni.New.
+// Peers that the Transport's Authorizer rejects can't be dialed.
+func (t *Transport) DialLink(ctx context.Context, id peer.ID) (*Link, error) {
+	if t.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	if !t.authorized(id) {
+		return nil, ErrUnauthorized
+	}
+	l := &Link{
+		t:       t,
+		peer:    id,
+		logger:  t.logger.With(zap.String("peer_id", id.String())),
+		started: time.Now(),
+	}
+	c, err := l.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.conn = c
+	l.ctx, l.cancel = context.WithCancel(t.ctx)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ctx.Err() != nil {
+		l.cancel()
+		_ = c.Reset()
+		return nil, ErrClosed
+	}
+	t.links[l] = struct{}{}
+	return l, nil
+}
+
+// Dial opens a stream to the remote peer and attaches it to the Transport's endpoint so
+// that packets from the endpoint are routed to the remote peer. Packets that the peer sends
+// back are subject to the same per-peer routes as the streams accepted by the Transport. If
+// the Transport was created without an endpoint, the Link is returned unattached just like
+// DialLink.
+func (t *Transport) Dial(ctx context.Context, id peer.ID) (*Link, error) {
+	l, err := t.DialLink(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if t.ep != nil {
+		go t.attach(&session{
+			peer:    id,
+			rw:      l,
+			logger:  l.logger,
+			started: l.started,
+		})
+	}
+	return l, nil
+}
+
+// Read reads the next packet from the stream. If the remote peer closed the stream, the
+// Link is closed and Read returns io.EOF. Writes can't tell that the peer closed the stream,
+// so they're discarded until a Read notices.
+func (l *Link) Read(p []byte) (n int, err error) {
+	for {
+		c, gen := l.current()
+		n, err = c.Read(p)
+		if err == nil || n > 0 {
+			l.bytesIn.Add(uint64(n))
+			return n, nil
+		}
+		if closedByPeer(err) {
+			l.logger.Debug("stream closed by peer", zap.Error(err))
+			_ = l.Close()
+			return 0, io.EOF
+		}
+		if err = l.reopen(gen, err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (l *Link) Write(p []byte) (n int, err error) {
+	for {
+		c, gen := l.current()
+		n, err = c.Write(p)
+		if err == nil {
+			l.bytesOut.Add(uint64(n))
+			return n, nil
+		}
+		if err = l.reopen(gen, err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close closes the Link and its stream. Any blocked reads or writes return io.EOF.
+func (l *Link) Close() error {
+	l.cancel()
+	l.t.mu.Lock()
+	delete(l.t.links, l)
+	l.t.mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	err := l.conn.Close("link closed")
+	l.t.dropConn(l.conn)
+	return err
+}
+
+// closedByPeer returns whether reading failed because the remote peer closed the stream, as
+// opposed to the stream being reset or the connection failing.
+func closedByPeer(err error) bool {
+	var closeErr *CloseError
+	return errors.Is(err, io.EOF) || errors.As(err, &closeErr)
+}
+
+// current returns the current connection and its generation.
+func (l *Link) current() (*packetConn, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn, l.gen
+}
+
+// reopen replaces the stream of the given generation after it failed with cause. If the
+// stream was already replaced by another reader or writer, reopen returns immediately, and
+// if another reader or writer is already replacing it, reopen waits for it to finish. It
+// retries with a backoff until a new stream is opened or the Link is closed. The mutex isn't
+// held while dialing, so the current stream can still be looked up in the meantime.
+func (l *Link) reopen(gen uint64, cause error) error {
+	l.mu.Lock()
+	if l.ctx.Err() != nil {
+		l.mu.Unlock()
+		return io.EOF
+	}
+	if l.gen != gen {
+		l.mu.Unlock()
+		return nil
+	}
+	if reopening := l.reopening; reopening != nil {
+		l.mu.Unlock()
+		select {
+		case <-reopening:
+			return nil
+		case <-l.ctx.Done():
+			return io.EOF
+		}
+	}
+	reopening := make(chan struct{})
+	l.reopening = reopening
+	old := l.conn
+	l.mu.Unlock()
+
+	c, err := l.redial(old, cause)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reopening = nil
+	close(reopening)
+	if err != nil {
+		return err
+	}
+	if l.ctx.Err() != nil {
+		// The link was closed while the stream was being opened
+		_ = c.Reset()
+		return io.EOF
+	}
+	l.conn = c
+	l.gen++
+	return nil
+}
+
+// redial resets the failed stream and opens a new one, retrying with a backoff until it
+// succeeds or the Link is closed.
+func (l *Link) redial(old *packetConn, cause error) (*packetConn, error) {
+	l.logger.Debug("re-opening stream", zap.Error(cause))
+	l.t.dropConn(old)
+	_ = old.Reset()
+
+	backoff := minReopenBackoff
+	for {
+		c, err := l.open(l.ctx)
+		if err == nil {
+			return c, nil
+		}
+		if l.ctx.Err() != nil {
+			return nil, io.EOF
+		}
+		l.logger.Warn("re-opening stream", zap.Error(err), zap.Duration("backoff", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-l.ctx.Done():
+			return nil, io.EOF
+		}
+		if backoff *= 2; backoff > maxReopenBackoff {
+			backoff = maxReopenBackoff
+		}
+	}
+}
+
+// open opens a new stream to the remote peer. ProtocolV1 is preferred, falling back to
+// Protocol for older peers. Neither protocol has a handshake other than the multistream
+// protocol negotiation performed by libp2p.
+func (l *Link) open(ctx context.Context) (*packetConn, error) {
+	s, err := l.t.host.NewStream(ctx, l.peer, ProtocolV1, Protocol)
+	if err != nil {
+		return nil, err
+	}
+	logger := l.logger.With(zap.String("id", s.ID()))
+	logger.Debug("opened stream", zap.String("protocol", string(s.Protocol())))
+	return l.t.newConn(s, logger), nil
+}
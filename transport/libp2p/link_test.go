@@ -0,0 +1,80 @@
+package transportp2p
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"time"
+)
+
+// resetSessions resets the streams that the transport accepted.
+func resetSessions(t *testing.T, tr *Transport) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	require.NotEmpty(t, tr.sessions)
+	for sess := range tr.sessions {
+		require.NoError(t, sess.conn.Reset())
+	}
+}
+
+func TestLinkReopensResetStreams(t *testing.T) {
+	exit := newTestExit(t)
+	l, fromExit := dialTestExit(t, exit)
+	p := ipv4Packet("100.64.0.2", "192.0.2.1", 1)
+	_, err := l.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, exit.packets, p)
+
+	// Reading from the reset stream re-opens it
+	resetSessions(t, exit.transport)
+	require.Eventually(t, func() bool {
+		_, gen := l.current()
+		return gen == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Writes and reads continue over the new stream
+	p = ipv4Packet("100.64.0.2", "192.0.2.1", 2)
+	_, err = l.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, exit.packets, p)
+	p = ipv4Packet("192.0.2.1", "100.64.0.2", 3)
+	_, err = exit.link.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, fromExit, p)
+	require.Len(t, exit.transport.Sessions(), 1)
+}
+
+func TestLinkClosedByPeer(t *testing.T) {
+	exit := newTestExit(t)
+	h := newTestHost(t)
+	tr, err := New(h, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+	l, err := dial(t, h, tr, exit.host)
+	require.NoError(t, err)
+	p := ipv4Packet("100.64.0.2", "192.0.2.1", 1)
+	_, err = l.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, exit.packets, p)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := l.Read(make([]byte, 1500))
+		read <- err
+	}()
+	require.True(t, exit.transport.Kick(h.ID()))
+	select {
+	case err = <-read:
+		require.ErrorIs(t, err, io.EOF)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "read didn't return after the peer closed the stream")
+	}
+
+	// The link is closed rather than re-opened
+	_, err = l.Write(p)
+	require.ErrorIs(t, err, io.EOF)
+	require.Empty(t, tr.Sessions())
+	requireNoPacket(t, exit.packets)
+	require.Empty(t, exit.transport.Sessions())
+	require.NoError(t, l.Close())
+}
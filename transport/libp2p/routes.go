@@ -0,0 +1,394 @@
+package transportp2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/zap"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"io"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// RoutesProtocol defines a libp2p protocol ID that exits use to advertise the routes
+// that they expose to the entrances that subscribe to them.
+const RoutesProtocol = "/rns/routes/0.0.1"
+
+// maxRoutesMessageSize is the size of the largest routes message that's accepted from a peer.
+const maxRoutesMessageSize = 0xffff
+
+// routesMessage is sent by the exit when a subscriber connects and every time the
+// advertised routes change. Messages are encoded as newline-delimited JSON.
+type routesMessage struct {
+	Routes []netip.Prefix `json:"routes"`
+}
+
+// WithRoutesHandler calls fn every time a remote peer that we're subscribed to, or that
+// we're connected to over ProtocolV1, advertises new routes. When the subscription ends, fn
+// is called with no routes. Use InstallRoutes to install the routes into an entrance's
+// routing table instead.
+func WithRoutesHandler(fn func(id peer.ID, routes []netip.Prefix)) Option {
+	return func(o *Config) {
+		o.OnRoutes = fn
+	}
+}
+
+// AdvertiseRoutes replaces the routes advertised to the peers subscribed to this transport.
+// This is typically called by exits with the same routes they pass to ExposeRoutes.
+// Routes are also pushed to every peer connected over ProtocolV1.
+func (t *Transport) AdvertiseRoutes(routes []netip.Prefix) {
+	t.mu.Lock()
+	t.advertised = append([]netip.Prefix(nil), routes...)
+	for _, notify := range t.subscribers {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+	conns := make([]*packetConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		if err := c.SendRoutes(routes); err != nil {
+			c.logger.Debug("sending routes", zap.Error(err))
+		}
+	}
+}
+
+// routesHandler handles streams from subscribers. It writes the advertised routes to the
+// stream and then writes them again every time they change.
+func (t *Transport) routesHandler(s network.Stream) {
+	defer s.Reset()
+	logger := t.logger.With(
+		zap.String("id", s.ID()),
+		zap.String("peer_id", s.Conn().RemotePeer().String()))
+	if !t.authorized(s.Conn().RemotePeer()) {
+		logger.Warn("rejecting routes subscription from unauthorized peer")
+		return
+	}
+	logger.Debug("accepting routes subscription")
+
+	notify := make(chan struct{}, 1)
+	notify <- struct{}{}
+	t.mu.Lock()
+	t.subscribers[s] = notify
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.subscribers, s)
+		t.mu.Unlock()
+	}()
+
+	// The subscriber never writes to the stream, so reading from it only returns once the
+	// subscriber goes away.
+	closed := make(chan struct{})
+	go func() {
+		_, _ = s.Read(make([]byte, 1))
+		close(closed)
+	}()
+
+	enc := json.NewEncoder(s)
+	for {
+		select {
+		case <-notify:
+		case <-closed:
+			return
+		}
+		t.mu.Lock()
+		msg := routesMessage{Routes: t.advertised}
+		t.mu.Unlock()
+		if err := enc.Encode(msg); err != nil {
+			logger.Debug("writing routes", zap.Error(err))
+			return
+		}
+	}
+}
+
+// SubscribeRoutes subscribes to the routes advertised by the remote peer. It returns once
+// the peer's current routes have been received. The subscription is re-opened when it
+// fails, and lasts until ctx is canceled or the transport is closed. Peers that the
+// Transport's Authorizer rejects can't be subscribed to.
+func (t *Transport) SubscribeRoutes(ctx context.Context, id peer.ID) error {
+	if t.ctx.Err() != nil {
+		return ErrClosed
+	}
+	if !t.authorized(id) {
+		return ErrUnauthorized
+	}
+	sub := &subscription{peer: id}
+	dec, s, err := t.openRoutes(ctx, sub)
+	if err != nil {
+		return err
+	}
+	logger := t.logger.With(zap.String("peer_id", id.String()))
+
+	// The subscription also ends when the transport is closed
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-t.ctx.Done():
+			cancel()
+		}
+	}()
+	go func() {
+		defer cancel()
+		defer t.dropRemoteRoutes(id, sub)
+		backoff := minReopenBackoff
+		for {
+			err = t.readRoutes(ctx, sub, dec, s)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Debug("re-opening routes subscription", zap.Error(err))
+			for {
+				dec, s, err = t.openRoutes(ctx, sub)
+				if err == nil {
+					backoff = minReopenBackoff
+					break
+				}
+				logger.Warn("re-opening routes subscription", zap.Error(err), zap.Duration("backoff", backoff))
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				if backoff *= 2; backoff > maxReopenBackoff {
+					backoff = maxReopenBackoff
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// subscription identifies the routes received over a routes subscription.
+type subscription struct {
+	peer peer.ID
+}
+
+// openRoutes opens a routes subscription stream and reads the initial routes from it.
+func (t *Transport) openRoutes(ctx context.Context, sub *subscription) (*routesDecoder, network.Stream, error) {
+	s, err := t.host.NewStream(ctx, sub.peer, RoutesProtocol)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := newRoutesDecoder(s)
+	var msg routesMessage
+	if err = dec.Decode(&msg); err != nil {
+		_ = s.Reset()
+		return nil, nil, err
+	}
+	t.setRemoteRoutes(sub.peer, sub, msg.Routes)
+	return dec, s, nil
+}
+
+// readRoutes reads route updates from the stream until it fails or ctx is canceled.
+func (t *Transport) readRoutes(ctx context.Context, sub *subscription, dec *routesDecoder, s network.Stream) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = s.Reset()
+	}()
+	for {
+		var msg routesMessage
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		t.setRemoteRoutes(sub.peer, sub, msg.Routes)
+	}
+}
+
+// routesDecoder decodes the newline-delimited routes messages of a subscription stream. Unlike
+// a json.Decoder, it refuses messages larger than maxRoutesMessageSize rather than buffering
+// whatever the peer sends.
+type routesDecoder struct {
+	r *bufio.Reader
+}
+
+func newRoutesDecoder(r io.Reader) *routesDecoder {
+	return &routesDecoder{r: bufio.NewReader(r)}
+}
+
+func (d *routesDecoder) Decode(msg *routesMessage) error {
+	var line []byte
+	for {
+		chunk, err := d.r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxRoutesMessageSize {
+			return errors.New("routes message too large")
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(line, msg)
+	}
+}
+
+// routeSource holds the routes that a peer advertised over one of its streams, which is either
+// a routes subscription or a ProtocolV1 connection.
+type routeSource struct {
+	routes []netip.Prefix
+	seq    uint64 // Orders the updates of the peer's sources, the latest one wins
+}
+
+// setRemoteRoutes records the routes advertised by the peer over the source and notifies the
+// routes handler.
+func (t *Transport) setRemoteRoutes(id peer.ID, source any, routes []netip.Prefix) {
+	t.mu.Lock()
+	sources, ok := t.remoteRoutes[id]
+	if !ok {
+		sources = map[any]routeSource{}
+		t.remoteRoutes[id] = sources
+	}
+	t.routesSeq++
+	sources[source] = routeSource{routes: routes, seq: t.routesSeq}
+	t.mu.Unlock()
+	t.routesChanged(id)
+}
+
+// dropRemoteRoutes forgets the routes advertised by the peer over the source once the source
+// is gone. The peer's routes fall back to the ones it advertised over its other sources.
+func (t *Transport) dropRemoteRoutes(id peer.ID, source any) {
+	t.mu.Lock()
+	sources := t.remoteRoutes[id]
+	if _, ok := sources[source]; !ok {
+		t.mu.Unlock()
+		return
+	}
+	delete(sources, source)
+	if len(sources) == 0 {
+		delete(t.remoteRoutes, id)
+	}
+	t.mu.Unlock()
+	t.routesChanged(id)
+}
+
+// routesChanged installs the peer's current routes and notifies the routes handler.
+func (t *Transport) routesChanged(id peer.ID) {
+	t.mu.Lock()
+	routes := t.peerRemoteRoutes(id)
+	installer := t.installers[id]
+	t.mu.Unlock()
+	t.logger.Debug("received routes", zap.String("peer_id", id.String()), zap.Int("routes", len(routes)))
+	if installer != nil {
+		installer.install(routes)
+	}
+	if t.onRoutes != nil {
+		t.onRoutes(id, routes)
+	}
+}
+
+// peerRemoteRoutes returns the routes that the peer advertised most recently over any of its
+// sources. The caller must hold mu.
+func (t *Transport) peerRemoteRoutes(id peer.ID) []netip.Prefix {
+	var latest routeSource
+	for _, s := range t.remoteRoutes[id] {
+		if s.seq > latest.seq {
+			latest = s
+		}
+	}
+	return latest.routes
+}
+
+// RouteTable is the routing table of an entrance, such as a vni.Interface.
+type RouteTable interface {
+	SetExitRoutes(id tcpip.NICID, routes []netip.Prefix, metric int) error
+}
+
+// InstallRoutes routes the prefixes that the peer advertises to the NIC of the table, and keeps
+// them up to date as the peer's routes change, until the returned function is called. This is
+// how entrances learn the routes of their exits, for example with the NIC of a link to the
+// exit. Each peer can only have one table, installing another one replaces it.
+func (t *Transport) InstallRoutes(id peer.ID, table RouteTable, nicId tcpip.NICID) (stop func()) {
+	installer := &routeInstaller{
+		table:  table,
+		nicId:  nicId,
+		logger: t.logger.With(zap.String("peer_id", id.String()), zap.Uint32("nic_id", uint32(nicId))),
+	}
+	t.mu.Lock()
+	t.installers[id] = installer
+	routes := t.peerRemoteRoutes(id)
+	t.mu.Unlock()
+	installer.install(routes)
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.installers[id] == installer {
+			delete(t.installers, id)
+		}
+	}
+}
+
+// routeInstaller installs the routes of a peer into a RouteTable.
+type routeInstaller struct {
+	table  RouteTable
+	nicId  tcpip.NICID
+	logger *zap.Logger
+}
+
+func (i *routeInstaller) install(routes []netip.Prefix) {
+	if err := i.table.SetExitRoutes(i.nicId, routes, 0); err != nil {
+		i.logger.Warn("installing routes", zap.Error(err))
+	}
+}
+
+// RemoteRoutes returns the routes advertised by each of the peers that we're subscribed to
+// or connected to over ProtocolV1.
+func (t *Transport) RemoteRoutes() map[peer.ID][]netip.Prefix {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	routes := make(map[peer.ID][]netip.Prefix, len(t.remoteRoutes))
+	for id := range t.remoteRoutes {
+		if r := t.peerRemoteRoutes(id); len(r) > 0 {
+			routes[id] = append([]netip.Prefix(nil), r...)
+		}
+	}
+	return routes
+}
+
+// LookupPeers returns the peers that advertise a route covering the whole prefix, ordered
+// from the most to the least specific route. Use netip.PrefixFrom(addr, addr.BitLen()) to
+// look up the peers that can reach a single address.
+func (t *Transport) LookupPeers(prefix netip.Prefix) []peer.ID {
+	prefix = prefix.Masked()
+	best := map[peer.ID]int{}
+	t.mu.Lock()
+	for id := range t.remoteRoutes {
+		for _, r := range t.peerRemoteRoutes(id) {
+			if r.Bits() <= prefix.Bits() && r.Contains(prefix.Addr()) {
+				if bits, ok := best[id]; !ok || r.Bits() > bits {
+					best[id] = r.Bits()
+				}
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	peers := make([]peer.ID, 0, len(best))
+	for id := range best {
+		peers = append(peers, id)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if best[peers[i]] == best[peers[j]] {
+			return peers[i] < peers[j]
+		}
+		return best[peers[i]] > best[peers[j]]
+	})
+	return peers
+}
@@ -0,0 +1,178 @@
+package transportp2p
+
+import (
+	"context"
+	"github.com/clarkmcc/remotenetstack/netstack/vni"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// routeTable records the routes installed into it.
+type routeTable struct {
+	mu     sync.Mutex
+	routes map[tcpip.NICID][]netip.Prefix
+}
+
+func (r *routeTable) SetExitRoutes(id tcpip.NICID, routes []netip.Prefix, _ int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.routes == nil {
+		r.routes = map[tcpip.NICID][]netip.Prefix{}
+	}
+	r.routes[id] = routes
+	return nil
+}
+
+func (r *routeTable) get(id tcpip.NICID) []netip.Prefix {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.routes[id]
+}
+
+func TestTransportInstallsRoutes(t *testing.T) {
+	exit := newTestExit(t)
+	routes := []netip.Prefix{netip.MustParsePrefix("10.20.0.0/16")}
+	exit.transport.AdvertiseRoutes(routes)
+
+	h := newTestHost(t)
+	tr, err := New(h, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: exit.host.ID(), Addrs: exit.host.Addrs()}))
+
+	table := &routeTable{}
+	stop := tr.InstallRoutes(exit.host.ID(), table, 1)
+	subCtx, unsubscribe := context.WithCancel(context.Background())
+	require.NoError(t, tr.SubscribeRoutes(subCtx, exit.host.ID()))
+	require.Equal(t, routes, table.get(1))
+	require.Equal(t, []peer.ID{exit.host.ID()}, tr.LookupPeers(netip.MustParsePrefix("10.20.1.0/24")))
+
+	// Updates replace the installed routes
+	routes = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+	exit.transport.AdvertiseRoutes(routes)
+	require.Eventually(t, func() bool {
+		return len(table.get(1)) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, routes, table.get(1))
+
+	// The routes are removed when the subscription ends
+	unsubscribe()
+	require.Eventually(t, func() bool {
+		return len(table.get(1)) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Routes aren't installed once the installer is stopped
+	stop()
+	require.NoError(t, tr.SubscribeRoutes(context.Background(), exit.host.ID()))
+	require.Empty(t, table.get(1))
+}
+
+func TestRoutesDecoder(t *testing.T) {
+	dec := newRoutesDecoder(strings.NewReader("{\"routes\":[\"10.0.0.0/8\"]}\n{\"routes\":[]}\n"))
+	var msg routesMessage
+	require.NoError(t, dec.Decode(&msg))
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, msg.Routes)
+	msg = routesMessage{}
+	require.NoError(t, dec.Decode(&msg))
+	require.Empty(t, msg.Routes)
+
+	// Peers can't make the subscriber buffer messages of any size
+	dec = newRoutesDecoder(strings.NewReader("{\"routes\":[\"" + strings.Repeat("1", maxRoutesMessageSize) + "\"]}\n"))
+	require.EqualError(t, dec.Decode(&msg), "routes message too large")
+}
+
+func TestRemoteRoutesPerSource(t *testing.T) {
+	tr, err := New(newTestHost(t), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+	id := peer.ID("exit")
+	sub, conn := &subscription{peer: id}, &packetConn{}
+	subRoutes := []netip.Prefix{netip.MustParsePrefix("10.20.0.0/16")}
+	connRoutes := []netip.Prefix{netip.MustParsePrefix("10.30.0.0/16")}
+
+	// The routes advertised most recently win
+	tr.setRemoteRoutes(id, sub, subRoutes)
+	tr.setRemoteRoutes(id, conn, connRoutes)
+	require.Equal(t, connRoutes, tr.RemoteRoutes()[id])
+
+	// Dropping a connection keeps the routes of the subscription
+	tr.dropRemoteRoutes(id, conn)
+	require.Equal(t, subRoutes, tr.RemoteRoutes()[id])
+	tr.dropRemoteRoutes(id, sub)
+	require.Empty(t, tr.RemoteRoutes())
+}
+
+func TestSubscriberSeesWithdrawnAndReplacedRoutes(t *testing.T) {
+	exit := newTestExit(t)
+	iface, err := vni.New(vni.Config{Mode: vni.Exit, LinkLayer: exit.link})
+	require.NoError(t, err)
+	t.Cleanup(iface.Stop)
+	advertise := func() {
+		exit.transport.AdvertiseRoutes(iface.ExposedRoutes())
+	}
+	require.NoError(t, iface.ExposeRoutes([]string{"10.1.0.0/16", "10.2.0.0/16"}))
+	advertise()
+
+	h := newTestHost(t)
+	tr, err := New(h, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: exit.host.ID(), Addrs: exit.host.Addrs()}))
+	table := &routeTable{}
+	defer tr.InstallRoutes(exit.host.ID(), table, 1)()
+	require.NoError(t, tr.SubscribeRoutes(ctx, exit.host.ID()))
+	require.Equal(t, prefixes("10.1.0.0/16", "10.2.0.0/16"), table.get(1))
+
+	requireRoutes := func(expected []netip.Prefix) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			return reflect.DeepEqual(expected, table.get(1))
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, expected, iface.ExposedRoutes())
+		for _, r := range prefixes("10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16") {
+			require.Equal(t, containsPrefix(expected, r), containsPrefix(iface.Routes(), r), r)
+		}
+	}
+
+	// Withdrawn routes are removed from the exit's routing table and from the subscriber
+	require.NoError(t, iface.WithdrawRoutes([]string{"10.1.0.0/16", "10.9.0.0/16"}))
+	advertise()
+	requireRoutes(prefixes("10.2.0.0/16"))
+
+	// Replacing the routes swaps all of them at once
+	require.NoError(t, iface.ReplaceRoutes([]string{"10.3.0.0/16", "10.1.0.0/16"}))
+	advertise()
+	requireRoutes(prefixes("10.3.0.0/16", "10.1.0.0/16"))
+
+	// Invalid routes leave the routes as they were
+	require.Error(t, iface.ReplaceRoutes([]string{"10.2.0.0/16", "invalid"}))
+	requireRoutes(prefixes("10.3.0.0/16", "10.1.0.0/16"))
+}
+
+func prefixes(s ...string) []netip.Prefix {
+	p := make([]netip.Prefix, 0, len(s))
+	for _, prefix := range s {
+		p = append(p, netip.MustParsePrefix(prefix))
+	}
+	return p
+}
+
+func containsPrefix(prefixes []netip.Prefix, p netip.Prefix) bool {
+	for _, prefix := range prefixes {
+		if prefix == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package transportp2p
+
+import (
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"github.com/clarkmcc/remotenetstack/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"io"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// SessionInfo describes a stream between the transport and a remote peer.
+type SessionInfo struct {
+	Peer      peer.ID
+	Addr      ma.Multiaddr      // The remote peer's address
+	Protocol  protocol.ID       // The protocol negotiated for the stream
+	Direction network.Direction // Inbound for streams accepted by the transport, outbound for links
+	BytesIn   uint64            // Bytes of packets received from the peer
+	BytesOut  uint64            // Bytes of packets sent to the peer
+	Addresses []netip.Addr      // The source addresses of the peer's packets, which packets addressed to are routed to it
+	Started   time.Time
+}
+
+// session is a link to a single remote peer that's attached to the transport's endpoint.
+type session struct {
+	peer     peer.ID
+	rw       io.ReadWriter
+	conn     *packetConn // The stream of an inbound session, nil for sessions backed by a Link
+	logger   *zap.Logger
+	started  time.Time
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+// Sessions returns the streams accepted by the transport and the links dialed by it.
+func (t *Transport) Sessions() []SessionInfo {
+	t.mu.Lock()
+	addrs := map[io.ReadWriter][]netip.Addr{}
+	for addr, sess := range t.routes {
+		addrs[sess.rw] = append(addrs[sess.rw], addr)
+	}
+	for _, a := range addrs {
+		sort.Slice(a, func(i, j int) bool { return a[i].Less(a[j]) })
+	}
+	infos := make([]SessionInfo, 0, len(t.sessions)+len(t.links))
+	for sess := range t.sessions {
+		if sess.conn == nil {
+			continue
+		}
+		infos = append(infos, SessionInfo{
+			Peer:      sess.peer,
+			Addr:      sess.conn.stream.Conn().RemoteMultiaddr(),
+			Protocol:  sess.conn.stream.Protocol(),
+			Direction: network.DirInbound,
+			BytesIn:   sess.bytesIn.Load(),
+			BytesOut:  sess.bytesOut.Load(),
+			Addresses: addrs[sess.rw],
+			Started:   sess.started,
+		})
+	}
+	links := make([]*Link, 0, len(t.links))
+	for l := range t.links {
+		links = append(links, l)
+	}
+	t.mu.Unlock()
+
+	// Links have to be inspected without holding the transport's lock, because links
+	// acquire it while re-opening their stream.
+	for _, l := range links {
+		c, _ := l.current()
+		infos = append(infos, SessionInfo{
+			Peer:      l.peer,
+			Addr:      c.stream.Conn().RemoteMultiaddr(),
+			Protocol:  c.stream.Protocol(),
+			Direction: network.DirOutbound,
+			BytesIn:   l.bytesIn.Load(),
+			BytesOut:  l.bytesOut.Load(),
+			Addresses: addrs[l],
+			Started:   l.started,
+		})
+	}
+	return infos
+}
+
+// Kick closes every stream and link between the transport and the remote peer. Unless the
+// peer is also rejected by the transport's Authorizer, it's free to open new streams.
+// Returns false if there was nothing to close.
+func (t *Transport) Kick(id peer.ID) bool {
+	var conns []*packetConn
+	var links []*Link
+	var streams []network.Stream
+	t.mu.Lock()
+	for sess := range t.sessions {
+		if sess.peer == id && sess.conn != nil {
+			conns = append(conns, sess.conn)
+		}
+	}
+	for l := range t.links {
+		if l.peer == id {
+			links = append(links, l)
+		}
+	}
+	for s := range t.subscribers {
+		if s.Conn().RemotePeer() == id {
+			streams = append(streams, s)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		_ = c.Close("kicked")
+	}
+	for _, l := range links {
+		_ = l.Close()
+	}
+	for _, s := range streams {
+		_ = s.Reset()
+	}
+	if len(conns)+len(links)+len(streams) == 0 {
+		return false
+	}
+	t.logger.Info("kicked peer", zap.String("peer_id", id.String()))
+	return true
+}
+
+// attach reads packets from the session and writes them to the endpoint until reading
+// fails. Packets to destinations that the peer isn't permitted to reach are dropped. The
+// source address of every packet is remembered so that packets addressed back to it are
+// routed to this session rather than to another peer's session, and packets from addresses
+// that belong to another peer's session are dropped.
+func (t *Transport) attach(sess *session) {
+	t.mu.Lock()
+	t.sessions[sess] = struct{}{}
+	t.mu.Unlock()
+	defer t.detach(sess)
+
+	buf := utils.GetBuf(16 * 1024)
+	defer utils.PutBuf(buf)
+	for {
+		n, err := sess.rw.Read(buf)
+		if err != nil {
+			sess.logger.Debug("session closed", zap.Error(err))
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		sess.bytesIn.Add(uint64(n))
+		src, dst, ok := netstack.PacketAddrs(buf[:n])
+		if !ok {
+			continue
+		}
+		if !t.permitted(sess.peer, dst) {
+			sess.logger.Debug("dropping packet to destination not permitted for peer",
+				zap.String("destination", dst.String()))
+			continue
+		}
+		if !t.learn(src, sess) {
+			sess.logger.Debug("dropping packet from address of another peer",
+				zap.String("source", src.String()))
+			continue
+		}
+		_, _ = t.ep.Write(buf[:n])
+	}
+}
+
+// detach removes the session and all the addresses that were routed to it.
+func (t *Transport) detach(sess *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, sess)
+	for addr, s := range t.routes {
+		if s == sess {
+			delete(t.routes, addr)
+		}
+	}
+}
+
+// learn routes packets addressed to addr to the session, and returns false if the address
+// belongs to another peer. An address belongs to the first session that sends from it until
+// that session is detached, so that a peer can't take over another peer's return traffic by
+// forging its address. Sessions of the same peer can take over each other's addresses, which
+// happens when a link re-opens its stream before the old stream is detached.
+func (t *Transport) learn(addr netip.Addr, sess *session) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, ok := t.routes[addr]
+	if ok && prev == sess {
+		return true
+	}
+	if ok && prev.peer != sess.peer {
+		return false
+	}
+	t.routes[addr] = sess
+	return true
+}
+
+// route returns the session that packets addressed to addr should be written to. Packets
+// to addresses that haven't been learned yet can only be routed when there's a single
+// session, otherwise there's no way to tell which peer they're meant for.
+func (t *Transport) route(addr netip.Addr) *session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if sess, ok := t.routes[addr]; ok {
+		return sess
+	}
+	if len(t.sessions) == 1 {
+		for sess := range t.sessions {
+			return sess
+		}
+	}
+	return nil
+}
+
+// dispatch reads packets from the endpoint and writes them to the session of the peer
+// that each packet is addressed to.
+func (t *Transport) dispatch() {
+	buf := utils.GetBuf(16 * 1024)
+	defer utils.PutBuf(buf)
+	for {
+		n, err := t.ep.Read(buf)
+		if err != nil {
+			return
+		}
+		_, dst, ok := netstack.PacketAddrs(buf[:n])
+		if !ok {
+			continue
+		}
+		sess := t.route(dst)
+		if sess == nil {
+			t.logger.Debug("dropping packet with no route to peer", zap.String("destination", dst.String()))
+			continue
+		}
+		if _, err = sess.rw.Write(buf[:n]); err != nil {
+			sess.logger.Debug("writing packet", zap.Error(err))
+			continue
+		}
+		sess.bytesOut.Add(uint64(n))
+	}
+}
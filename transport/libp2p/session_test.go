@@ -0,0 +1,270 @@
+package transportp2p
+
+import (
+	"context"
+	"github.com/clarkmcc/remotenetstack/netstack"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testExit is a transport that accepts links, along with the link layer that an exit
+// interface would be attached to.
+type testExit struct {
+	host      host.Host
+	transport *Transport
+	link      *netstack.ChannelLink
+	packets   <-chan []byte // The packets that the transport wrote to the link layer
+}
+
+func newTestHost(t *testing.T) host.Host {
+	h, err := MakeTestHost(0)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = h.Close() })
+	return h
+}
+
+func newTestExit(t *testing.T, opts ...Option) *testExit {
+	h := newTestHost(t)
+	ep := channel.New(64, 1500, "")
+	tr, err := New(h, ep, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+	link := netstack.NewChannelLink(ep)
+	t.Cleanup(func() { _ = link.Close() })
+	return &testExit{host: h, transport: tr, link: link, packets: readPackets(link)}
+}
+
+// dialTestExit connects a new host to the exit and dials a link to it.
+func dialTestExit(t *testing.T, exit *testExit, opts ...Option) (*Link, <-chan []byte) {
+	h := newTestHost(t)
+	tr, err := New(h, nil, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+	l, err := dial(t, h, tr, exit.host)
+	require.NoError(t, err)
+	return l, readPackets(l)
+}
+
+// dial connects the host to the remote host and dials a link to it.
+func dial(t *testing.T, h host.Host, tr *Transport, remote host.Host) (*Link, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: remote.ID(), Addrs: remote.Addrs()}))
+	return tr.DialLink(ctx, remote.ID())
+}
+
+// readPackets reads packets from r until reading fails.
+func readPackets(r io.Reader) <-chan []byte {
+	packets := make(chan []byte, 64)
+	go func() {
+		defer close(packets)
+		for {
+			buf := make([]byte, 1500)
+			n, err := r.Read(buf)
+			if err != nil {
+				return
+			}
+			packets <- buf[:n]
+		}
+	}()
+	return packets
+}
+
+// ipv4Packet returns an IPv4 packet whose payload is a single byte that tells packets apart.
+func ipv4Packet(src, dst string, payload byte) []byte {
+	p := make([]byte, header.IPv4MinimumSize+1)
+	header.IPv4(p).Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(p)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.Address(netip.MustParseAddr(src).AsSlice()),
+		DstAddr:     tcpip.Address(netip.MustParseAddr(dst).AsSlice()),
+	})
+	p[header.IPv4MinimumSize] = payload
+	return p
+}
+
+// requirePacket requires the next packet to be the expected one.
+func requirePacket(t *testing.T, packets <-chan []byte, expected []byte) {
+	t.Helper()
+	select {
+	case p := <-packets:
+		require.Equal(t, expected, p)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timed out waiting for packet")
+	}
+}
+
+// requireNoPacket requires that no packet arrives for a little while.
+func requireNoPacket(t *testing.T, packets <-chan []byte) {
+	t.Helper()
+	select {
+	case p := <-packets:
+		require.Fail(t, "unexpected packet", "%v", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestTransportRoutesToPeers(t *testing.T) {
+	exit := newTestExit(t)
+	a, fromA := dialTestExit(t, exit)
+	b, fromB := dialTestExit(t, exit)
+
+	// The exit learns the address of each entrance from the packets it sends
+	p := ipv4Packet("100.64.0.2", "192.0.2.1", 1)
+	_, err := a.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, exit.packets, p)
+	p = ipv4Packet("100.64.0.3", "192.0.2.1", 2)
+	_, err = b.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, exit.packets, p)
+
+	// Replies are routed to the entrance that they're addressed to
+	for _, to := range []struct {
+		addr    string
+		packets <-chan []byte
+	}{{"100.64.0.2", fromA}, {"100.64.0.3", fromB}} {
+		p = ipv4Packet("192.0.2.1", to.addr, 3)
+		_, err = exit.link.Write(p)
+		require.NoError(t, err)
+		requirePacket(t, to.packets, p)
+	}
+	requireNoPacket(t, fromA)
+	requireNoPacket(t, fromB)
+}
+
+func TestTransportDropsForgedSource(t *testing.T) {
+	exit := newTestExit(t)
+	a, fromA := dialTestExit(t, exit)
+	b, fromB := dialTestExit(t, exit)
+
+	p := ipv4Packet("100.64.0.2", "192.0.2.1", 1)
+	_, err := a.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, exit.packets, p)
+
+	// B can't send from A's address, and doesn't take over A's return traffic by trying
+	_, err = b.Write(ipv4Packet("100.64.0.2", "192.0.2.1", 2))
+	require.NoError(t, err)
+	requireNoPacket(t, exit.packets)
+	p = ipv4Packet("192.0.2.1", "100.64.0.2", 3)
+	_, err = exit.link.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, fromA, p)
+	requireNoPacket(t, fromB)
+
+	// Once A is gone, its address is free to be used by another entrance
+	require.NoError(t, a.Close())
+	require.Eventually(t, func() bool {
+		exit.transport.mu.Lock()
+		defer exit.transport.mu.Unlock()
+		return len(exit.transport.sessions) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	p = ipv4Packet("100.64.0.2", "192.0.2.1", 4)
+	_, err = b.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, exit.packets, p)
+}
+
+func TestTransportSessions(t *testing.T) {
+	exit := newTestExit(t)
+	h := newTestHost(t)
+	tr, err := New(h, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+	tr.AdvertiseRoutes([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	l, err := dial(t, h, tr, exit.host)
+	require.NoError(t, err)
+	p := ipv4Packet("100.64.0.2", "192.0.2.1", 1)
+	_, err = l.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, exit.packets, p)
+
+	// The exit lists the entrance's stream, the addresses it sends from and its routes
+	sessions := exit.transport.Sessions()
+	require.Len(t, sessions, 1)
+	require.Equal(t, h.ID(), sessions[0].Peer)
+	require.Equal(t, network.DirInbound, sessions[0].Direction)
+	require.Equal(t, protocol.ID(ProtocolV1), sessions[0].Protocol)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("100.64.0.2")}, sessions[0].Addresses)
+	require.Equal(t, uint64(len(p)), sessions[0].BytesIn)
+	require.Eventually(t, func() bool {
+		return len(exit.transport.RemoteRoutes()[h.ID()]) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// And the entrance lists its link
+	sessions = tr.Sessions()
+	require.Len(t, sessions, 1)
+	require.Equal(t, exit.host.ID(), sessions[0].Peer)
+	require.Equal(t, network.DirOutbound, sessions[0].Direction)
+	require.Equal(t, uint64(len(p)), sessions[0].BytesOut)
+}
+
+func TestTransportKick(t *testing.T) {
+	exit := newTestExit(t)
+	h := newTestHost(t)
+	tr, err := New(h, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+	tr.AdvertiseRoutes([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	l, err := dial(t, h, tr, exit.host)
+	require.NoError(t, err)
+	p := ipv4Packet("100.64.0.2", "192.0.2.1", 1)
+	_, err = l.Write(p)
+	require.NoError(t, err)
+	requirePacket(t, exit.packets, p)
+	require.Eventually(t, func() bool {
+		return len(exit.transport.RemoteRoutes()[h.ID()]) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	dialTestExit(t, exit) // Another entrance, which stays connected
+
+	// Kicking drops the peer's stream, the addresses routed to it and its routes
+	require.True(t, exit.transport.Kick(h.ID()))
+	require.Eventually(t, func() bool {
+		return len(exit.transport.Sessions()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NotEqual(t, h.ID(), exit.transport.Sessions()[0].Peer)
+	require.Empty(t, exit.transport.RemoteRoutes()[h.ID()])
+	exit.transport.mu.Lock()
+	require.Empty(t, exit.transport.routes)
+	exit.transport.mu.Unlock()
+	_, err = l.Read(make([]byte, 1500))
+	require.ErrorIs(t, err, io.EOF)
+
+	// Peers without streams can't be kicked
+	require.False(t, exit.transport.Kick(h.ID()))
+}
+
+func TestTransportClose(t *testing.T) {
+	exit := newTestExit(t)
+	h := newTestHost(t)
+	tr, err := New(h, channel.New(64, 1500, ""))
+	require.NoError(t, err)
+	l, err := dial(t, h, tr, exit.host)
+	require.NoError(t, err)
+	require.NoError(t, tr.SubscribeRoutes(context.Background(), exit.host.ID()))
+
+	require.NoError(t, tr.Close())
+	_, err = l.Read(make([]byte, 1500))
+	require.ErrorIs(t, err, io.EOF)
+	require.Empty(t, tr.Sessions())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = tr.DialLink(ctx, exit.host.ID())
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = tr.Dial(ctx, exit.host.ID())
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, tr.SubscribeRoutes(ctx, exit.host.ID()), ErrClosed)
+	require.NoError(t, tr.Close())
+}
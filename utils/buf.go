@@ -15,6 +15,9 @@ var (
 
 // Join joins the two readers. Both are piped to each other and closed
 // once everything has been read from each and written to the other.
+// Writers that can be half-closed, like TCP connections, are closed for
+// writing as soon as their reader is done, so that the other side sees
+// the end of the stream.
 func Join(local io.ReadWriter, remote io.ReadWriter) (bytesTransferred int64) {
 	var wg sync.WaitGroup
 	pipe := func(to io.ReadWriter, from io.ReadWriter, count *int64) {
@@ -22,6 +25,9 @@ func Join(local io.ReadWriter, remote io.ReadWriter) (bytesTransferred int64) {
 		buf := GetBuf(16 * 1024)
 		defer PutBuf(buf)
 		*count, _ = io.CopyBuffer(to, from, buf)
+		if cw, ok := to.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
 	}
 
 	var inCount, outCount int64
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	conn := <-accepted
+	require.NotNil(t, conn)
+	t.Cleanup(func() {
+		_ = dialed.Close()
+		_ = conn.Close()
+	})
+	return dialed.(*net.TCPConn), conn.(*net.TCPConn)
+}
+
+func TestJoinHalfCloses(t *testing.T) {
+	// client <-> local ~Join~ remote <-> server
+	client, local := tcpPair(t)
+	remote, server := tcpPair(t)
+	done := make(chan int64, 1)
+	go func() { done <- Join(local, remote) }()
+
+	// The server sees the end of the request while the client still waits for the response,
+	// as with protocols where the client half-closes after sending its request
+	_, err := client.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, client.CloseWrite())
+	request, err := io.ReadAll(server)
+	require.NoError(t, err)
+	require.Equal(t, "request", string(request))
+
+	_, err = server.Write([]byte("response"))
+	require.NoError(t, err)
+	require.NoError(t, server.CloseWrite())
+	response, err := io.ReadAll(client)
+	require.NoError(t, err)
+	require.Equal(t, "response", string(response))
+	require.Equal(t, int64(len("request")+len("response")), <-done)
+}